@@ -1,16 +1,17 @@
 package gosh
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -26,19 +27,45 @@ import (
 // Much appreciation to the author!
 
 type App struct {
+	// BashPath is the path to the shell interpreter, which may not be bash depending on Dialect
 	BashPath   string
+	Dialect    ShellDialect
 	Dir        string
 	TriggerArg string
 	SelfPath   string
 	SelfArgs   []string
 	Pkg        string
+	BuildTags  []string
+	BuildFlags []string
 	Debug      bool
 	Env        []string
 
+	// Sources are the absolute paths to the shell scripts sourced into every shell
+	Sources []string
+
+	Interactive   InteractiveConfig
+	OnStart       []SessionHook
+	OnExit        []SessionHook
+	OnScriptError []ScriptErrorHook
+
+	// NoErrTrap disables the ERR trap installed into non-interactive shells
+	NoErrTrap bool
+
 	funcs map[string]FunWithOpts
+
+	// shell is the Shell that created the app, which is given to the functions via Context
+	shell *Shell
+
+	// shellFuncs are the shell functions defined in the sources, which is nil until they're listed successfully
+	shellFuncs   map[string]struct{}
+	shellFuncsMu sync.Mutex
 }
 
 func (c *App) HandleFuncs(ctx context.Context, args []interface{}, outs []Output) (bool, error) {
+	if c.shell != nil {
+		ctx = context.WithValue(ctx, shellKey{}, c.shell)
+	}
+
 	retVals, ret, err := c.handleFuncs(ctx, args, outs, map[FunID]struct{}{})
 
 	if err != nil {
@@ -62,6 +89,9 @@ func (c *App) handleFuncs(ctx context.Context, args []interface{}, outs []Output
 				}
 
 				if cmd == args[i+1] {
+					// The deps run in the scope of the function, so that they can export variables to it
+					ctx := context.WithScope(ctx)
+
 					for _, d := range funWithOpts.Opts.Deps {
 						_, v, err := c.handleFuncs(ctx, append([]interface{}{d.Name}, d.Args...), nil, called)
 						if !v {
@@ -108,6 +138,9 @@ func (c *App) handleFuncs(ctx context.Context, args []interface{}, outs []Output
 
 	// Without :::
 	if funWithOpts, ok := c.funcs[fnName]; ok {
+		// The deps run in the scope of the function, so that they can export variables to it
+		ctx := context.WithScope(ctx)
+
 		for _, d := range funWithOpts.Opts.Deps {
 			_, v, err := c.handleFuncs(ctx, append([]interface{}{d.Name}, d.Args...), nil, called)
 			if !v {
@@ -156,15 +189,8 @@ func (c *App) printEnv(file io.Writer, interactive bool) {
 
 	selfArgs = append(selfArgs, c.SelfArgs...)
 
-	var buildArgs []string
-
-	if buildTag := os.Getenv("GOSH_BUILD_TAG"); buildTag != "" {
-		buildArgs = append(buildArgs, "-tags="+buildTag)
-	}
-	buildArgs = append(buildArgs, c.Pkg)
-
 	// variables
-	file.Write([]byte("unset BASH_ENV\n")) // unset for future calls to bash
+	file.Write([]byte(c.dialect().Preamble()))
 	file.Write([]byte("export SELF=" + os.Args[0] + "\n"))
 	file.Write([]byte("export SELF_ARGS=\"" + strings.Join(selfArgs, " ") + "\"\n"))
 	file.Write([]byte("export SELF_EXECUTABLE='" + c.SelfPath + "'\n"))
@@ -174,56 +200,69 @@ func (c *App) printEnv(file io.Writer, interactive bool) {
 	if len(c.funcs) > 0 {
 		file.Write([]byte(`
 mkdir -p .cmds
-export PATH=$(pwd)/.cmds:$PATH
+export PATH="$(pwd)/.cmds${PATH:+:$PATH}"
 `))
 	}
 	for cmd := range c.funcs {
 		file.Write([]byte(`
 cat <<'EOS' > .cmds/` + cmd + `
-#!/usr/bin/env bash
-$SELF_EXECUTABLE $SELF_ARGS ::: ` + cmd + ` "$@"
-EOS
+` + c.dialect().Shim(c.TriggerArg, cmd) + `EOS
 chmod +x .cmds/` + cmd + `
 `))
-		// file.Write([]byte(cmd + "() { $SELF_EXECUTABLE ::: " + cmd + " \"$@\"; }\n"))
-	}
-	// 	file.Write([]byte(`
-	// _gosh_hook() {
-	// 	local previous_exit_status=$?;
-	// 	trap -- '' SIGINT;
-	// 	go build -o run2 ./run;
-	// 	export SELF_EXECUTABLE=$(pwd)/run2;
-	// 	trap - SIGINT;
-	// 	return $previous_exit_status;
-	// };
-	// if ! [[ "${PROMPT_COMMAND:-}" =~ _direnv_hook ]]; then
-	// 	PROMPT_COMMAND="_gosh_hook${PROMPT_COMMAND:+;$PROMPT_COMMAND}"
-	// fi
-	// `))
+		// The function takes precedence over the shim within the shell session,
+		// so that the exported function is able to modify the calling shell.
+		file.Write([]byte(c.dialect().Function(c.TriggerArg, cmd)))
+	}
+	if !interactive && !c.NoErrTrap {
+		file.Write([]byte(c.dialect().ErrTrap()))
+	}
+	if len(c.Sources) > 0 {
+		file.Write([]byte("\n" + c.sourceScript()))
+	}
 	if c.Pkg != "" && interactive {
-		file.Write([]byte(`
-preexec () { :; }
-preexec_invoke_exec () {
-[ -n "$COMP_LINE" ] && return  # do nothing if completing
-[ "$BASH_COMMAND" = "$PROMPT_COMMAND" ] && return # don't cause a preexec for $PROMPT_COMMAND
-NEWBIN=run2
-go build -o $NEWBIN ` + strings.Join(buildArgs, " ") + `
-export SELF_EXECUTABLE=$(pwd)/$NEWBIN
-eval "$(./$NEWBIN env)"
-}
-trap 'preexec_invoke_exec' DEBUG
-`))
+		// Don't shadow the exported function of the same name
+		builtin := reloadBuiltin
+		if _, ok := c.funcs[builtin]; ok {
+			builtin = ""
+		}
+		file.Write([]byte(c.dialect().ReloadHook(builtin)))
 	}
 }
 
-func (c *App) buildEnvfile(interactive bool) (string, error) {
-	files, err := filepath.Glob(filepath.Join(c.Dir, "bashenv.*"))
-	if err != nil {
-		return "", fmt.Errorf("failed globbing bashenv files: %w", err)
+func (c *App) dialect() ShellDialect {
+	if c.Dialect == nil {
+		return Bash
 	}
 
-	if len(files) > 5 {
-		return "", fmt.Errorf("too many bashenv files found (%d). perhaps you've falling into a infinite recursion?", len(files))
+	return c.Dialect
+}
+
+func (c *App) shellPath() string {
+	if c.BashPath == "" {
+		return c.dialect().DefaultPath()
+	}
+
+	return c.BashPath
+}
+
+const (
+	// depthEnv is the name of the envvar that counts the shells started by gosh from within a shell started by gosh
+	depthEnv = "GOSH_DEPTH"
+
+	// maxDepth is the max number of the nested shells, which is likely to be reached only by an infinite recursion
+	maxDepth = 32
+)
+
+// depth returns the number of the shells started by gosh that run the command within ctx.
+func depth(ctx context.Context) int {
+	d, _ := strconv.Atoi(getenv(context.Environ(ctx), depthEnv))
+
+	return d
+}
+
+func (c *App) buildEnvfile(ctx context.Context, interactive bool) (string, error) {
+	if d := depth(ctx); d >= maxDepth {
+		return "", fmt.Errorf("too many nested shells (%d). perhaps you've fallen into an infinite recursion?", d)
 	}
 
 	file, err := ioutil.TempFile(c.Dir, "bashenv.")
@@ -232,6 +271,12 @@ func (c *App) buildEnvfile(interactive bool) (string, error) {
 	}
 	defer file.Close()
 
+	// This isn't a part of printEnv, as the env is reloaded before every command in an interactive session.
+	// It comes first, so that the user's rc file never overrides the functions defined by the env.
+	if interactive {
+		file.Write([]byte(c.dialect().InteractiveRC(c.Interactive)))
+	}
+
 	c.printEnv(file, interactive)
 
 	return file.Name(), nil
@@ -245,25 +290,58 @@ func (c *App) runInteractiveShell(ctx context.Context) (int, error) {
 		interactive = terminal.IsTerminal(int(osFile.Fd()))
 	}
 
-	return c.runInternal(ctx, interactive, nil, RunConfig{})
+	if !interactive {
+		return c.runInternal(ctx, interactive, nil, RunConfig{})
+	}
+
+	if c.Pkg == "" && c.Debug {
+		fmt.Fprintf(os.Stderr, "gosh: hot reloading is disabled, as the main package isn't found. Set Config.Pkg to enable it\n")
+	}
+
+	if c.Pkg != "" {
+		if err := c.adopt(ctx); err != nil && c.Debug {
+			fmt.Fprintf(os.Stderr, "gosh: unable to adopt the running binary for hot reloading: %v\n", err)
+		}
+	}
+
+	if err := c.runSessionHooks(ctx, "start", c.OnStart); err != nil {
+		return 0, err
+	}
+
+	status, err := c.runInternal(ctx, interactive, nil, RunConfig{})
+
+	if hookErr := c.runSessionHooks(ctx, "exit", c.OnExit); hookErr != nil && err == nil {
+		err = hookErr
+	}
+
+	return status, err
 }
 
 func (c *App) runNonInteractiveShell(ctx context.Context, args []string, cfg RunConfig) (int, error) {
 	var isCmd bool
+	var err error
 
 	if len(args) > 0 {
 		if info, _ := os.Stat(args[0]); info == nil {
 			isCmd = true
+		} else if isCmd, err = c.isShellFunc(ctx, args[0]); err != nil {
+			return 0, err
 		}
 	}
 
 	var bashArgs []string
 
 	if isCmd {
+		if path, ok, err := c.lookPath(ctx, args[0]); err != nil {
+			return 0, err
+		} else if ok {
+			return c.runCommand(ctx, path, args[1:], cfg)
+		}
+
 		bashArgs = append(bashArgs, "-c")
 		var bashCmd []string
-		for _, a := range args {
-			bashCmd = append(bashCmd, `"`+strings.ReplaceAll(a, `"`, `\"`)+`"`)
+		for i, a := range args {
+			bashCmd = append(bashCmd, shellWord(a, i == 0))
 		}
 		bashArgs = append(bashArgs, strings.Join(bashCmd, " "))
 	} else {
@@ -274,7 +352,7 @@ func (c *App) runNonInteractiveShell(ctx context.Context, args []string, cfg Run
 }
 
 func (c *App) runInternal(ctx context.Context, interactive bool, args []string, cfg RunConfig) (int, error) {
-	envfile, err := c.buildEnvfile(interactive)
+	envfile, err := c.buildEnvfile(ctx, interactive)
 	if err != nil {
 		return 0, err
 	}
@@ -282,58 +360,51 @@ func (c *App) runInternal(ctx context.Context, interactive bool, args []string,
 		defer os.Remove(envfile)
 	}
 
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals)
-	// Avoid receiving "urgent I/O condition" signals
-	// See https://golang.hateblo.jp/entry/golang-signal-urgent-io-condition
-	signal.Ignore(syscall.Signal(0x17))
+	dispatcher, err := c.startDispatcher(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer dispatcher.Close()
 
-	bashArgs := []string{}
+	shellArgs, shellEnv := c.dialect().Command(envfile, interactive, args)
 
-	if interactive {
-		bashArgs = append(bashArgs, "--rcfile", envfile)
+	diags, err := newDiagnostics()
+	if err != nil {
+		return 0, err
 	}
 
-	bashArgs = append(bashArgs, args...)
+	cmd := c.command(ctx, dispatcher, c.shellPath(), shellArgs, shellEnv)
+	diags.attach(cmd)
 
-	// println(fmt.Sprintf("App.run: running %v: bashArgs %v (%d)", args, bashArgs, len(bashArgs)))
+	err = runProcess(ctx, cmd, interactive, killAfter(ctx))
 
-	cmd := exec.CommandContext(ctx, c.BashPath, bashArgs...)
-	cmd.Env = os.Environ()
-	if !interactive {
-		cmd.Env = append(cmd.Env, "BASH_ENV="+envfile)
+	status, _ := exitStatus(err)
+
+	return status, diags.close(err)
+}
+
+// command returns the command to run the executable at path with args, calling exported functions via the dispatcher.
+// It runs in the working directory and with the environment variables of ctx.
+func (c *App) command(ctx context.Context, dispatcher *dispatcher, path string, args, env []string) *exec.Cmd {
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(cmd.Env, context.Environ(ctx)...)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Dir = context.Dir(ctx)
+	cmd.Env = append(cmd.Env, DispatcherSocketEnv+"="+dispatcher.Path())
+	cmd.Env = append(cmd.Env, depthEnv+"="+strconv.Itoa(depth(ctx)+1))
+	// A nested shell shares the session variables with the outer one
+	if getenv(cmd.Env, context.VarsFileEnv) == "" {
+		cmd.Env = append(cmd.Env, context.VarsFileEnv+"="+dispatcher.varsFile())
 	}
-	cmd.Dir = cfg.Dir
-	cmd.Env = append(cmd.Env, cfg.Env...)
 	cmd.Stdin = context.Stdin(ctx)
 	cmd.Stdout = context.Stdout(ctx)
 	cmd.Stderr = context.Stderr(ctx)
-	if err := cmd.Start(); err != nil {
-		return 0, err
-	}
-	errChan := make(chan error, 1)
-	go func() {
-		for sig := range signals {
-			if sig != syscall.SIGCHLD {
-				// fmt.Fprintf(os.Stderr, "signal received: %v\n", sig)
-				err = cmd.Process.Signal(sig)
-				if err != nil {
-					errChan <- err
-				}
-			}
-		}
-	}()
-	go func() {
-		errChan <- cmd.Wait()
-	}()
-	err = <-errChan
-	return exitStatus(err)
+
+	return cmd
 }
 
 func (app *App) Run(ctx context.Context, args []interface{}, cfg RunConfig) error {
 	outs := cfg.Outputs
-	stdout := cfg.Stdout
-	stderr := cfg.Stderr
 
 	if len(args) == 1 && args[0] == "env" {
 		app.printEnv(os.Stdout, true)
@@ -341,6 +412,12 @@ func (app *App) Run(ctx context.Context, args []interface{}, cfg RunConfig) erro
 		return nil
 	}
 
+	if len(args) > 0 && args[0] == reloadArg {
+		force := len(args) > 1 && args[1] == reloadForceFlag
+
+		return app.reload(ctx, os.Stdout, force)
+	}
+
 	if ctx == nil {
 		ctx = context.Background()
 		ctx = context.WithStdin(ctx, os.Stdin)
@@ -348,44 +425,168 @@ func (app *App) Run(ctx context.Context, args []interface{}, cfg RunConfig) erro
 		ctx = context.WithStderr(ctx, os.Stderr)
 	}
 
-	if stdout.w != nil {
-		ctx = context.WithStdout(ctx, stdout.w)
+	ctx = app.withRunConfig(ctx, cfg)
+
+	ctx, closeStdin, err := withStdin(ctx, cfg.Stdin)
+	if err != nil {
+		return err
 	}
+	defer closeStdin()
 
-	if stderr.w != nil {
-		ctx = context.WithStderr(ctx, stderr.w)
+	cfg, closeStdout, err := openStdoutFile(cfg, context.Dir(ctx))
+	if err != nil {
+		return err
 	}
+	defer closeStdout()
 
-	ctx = context.WithVariables(ctx, map[string]interface{}{})
+	ctx, explicitStdout, flushOutputs := withOutputs(ctx, cfg)
+	defer flushOutputs()
+
+	ctx, decodeCaptures := withCaptures(ctx, cfg.Captures, explicitStdout)
+
+	// Variables set in the caller of a nested Run are visible to the functions
+	if !context.HasScope(ctx) {
+		ctx = context.WithScope(ctx)
+	}
 
 	if len(args) == 0 {
 		_, err := app.runInteractiveShell(ctx)
 
-		return err
+		return newExitError([]string{app.shellPath()}, err, nil)
 	}
 
-	funExists, err := app.HandleFuncs(ctx, args, outs)
-	if err != nil {
-		fmt.Fprintf(context.Stderr(ctx), "%v\n", err)
-		return err
-	}
+	// A script is always run by the shell, even if it's named like an exported function
+	script, isScript := args[0].(Script)
 
-	if funExists {
-		return nil
+	if !isScript {
+		funExists, err := app.HandleFuncs(ctx, args, outs)
+		if err != nil {
+			// The failed command has already written its own error to stderr,
+			// and so has the upstream command in a pipeline.
+			// A command that stopped as the downstream exited isn't an error to report, as with SIGPIPE.
+			var exitErr *ExitError
+			if !errors.As(err, &exitErr) && !isUpstreamError(err) && !isBrokenPipe(err) {
+				fmt.Fprintf(context.Stderr(ctx), "%v\n", err)
+			}
+			return err
+		}
+
+		if funExists {
+			return decodeCaptures()
+		}
 	}
 
 	var shellArgs []string
 	for _, v := range args {
-		if s, ok := v.(string); !ok {
+		if s, ok := v.(Script); ok {
+			shellArgs = append(shellArgs, string(s))
+		} else if s, ok := v.(string); !ok {
 			return fmt.Errorf("%v(%T) cannot be converted to string", v, v)
 		} else {
 			shellArgs = append(shellArgs, s)
 		}
 	}
 
-	_, err = app.runNonInteractiveShell(ctx, shellArgs, cfg)
+	// Keep the tail of stderr for ExitError, unless the command writes directly to the terminal,
+	// which the user has already seen, and which the command may need to detect to e.g. colorize the output
+	var stderrTail *tailWriter
+	if f, ok := context.Stderr(ctx).(*os.File); !ok || !terminal.IsTerminal(int(f.Fd())) {
+		combined := sameWriter(context.Stdout(ctx), context.Stderr(ctx))
 
-	return err
+		stderrTail = newTailWriter(context.Stderr(ctx), maxStderrTail)
+		ctx = context.WithStderr(ctx, stderrTail)
+
+		// Keep writing both to the same writer, so that the order is kept
+		if combined {
+			ctx = context.WithStdout(ctx, stderrTail)
+		}
+	}
+
+	if isScript {
+		_, err = app.runScript(ctx, string(script), shellArgs[1:], cfg)
+	} else {
+		_, err = app.runNonInteractiveShell(ctx, shellArgs, cfg)
+	}
+
+	err = newExitError(shellArgs, err, stderrTail)
+
+	app.runScriptErrorHooks(ctx, err)
+
+	if err != nil {
+		return err
+	}
+
+	return decodeCaptures()
+}
+
+// withRunConfig returns the context carrying the Env and Dir of cfg,
+// so that they apply to the exported Go functions and the nested Runs as well as the commands.
+// A relative Dir is relative to the working directory of ctx, as `cd` is.
+func (app *App) withRunConfig(ctx context.Context, cfg RunConfig) context.Context {
+	dir, ok := context.LookupDir(ctx)
+	if !ok {
+		dir = app.Dir
+	}
+
+	if cfg.Dir != "" {
+		if filepath.IsAbs(cfg.Dir) || dir == "" {
+			dir = cfg.Dir
+		} else {
+			dir = filepath.Join(dir, cfg.Dir)
+		}
+	}
+
+	if dir != "" {
+		ctx = context.WithDir(ctx, dir)
+	}
+
+	if cfg.CleanEnv || len(cfg.InheritEnv) > 0 {
+		environ := context.Environ(ctx)
+
+		var env []string
+
+		// The session variables are shared regardless of the environment
+		for _, k := range append([]string{context.VarsFileEnv}, cfg.InheritEnv...) {
+			if v, ok := lookupEnv(environ, k); ok {
+				env = append(env, k+"="+v)
+			}
+		}
+
+		ctx = context.WithEnviron(ctx, env)
+	}
+
+	if len(cfg.Env) > 0 {
+		var env []string
+		env = append(env, context.Environ(ctx)...)
+		env = append(env, cfg.Env...)
+
+		ctx = context.WithEnviron(ctx, env)
+	}
+
+	if cfg.KillAfter > 0 {
+		ctx = context.WithValue(ctx, killAfterKey{}, cfg.KillAfter)
+	}
+
+	return ctx
+}
+
+// getenv returns the value of the environment variable named key in env.
+// The last one wins, as it does in exec.Cmd.Env.
+func getenv(env []string, key string) string {
+	v, _ := lookupEnv(env, key)
+
+	return v
+}
+
+// lookupEnv is like getenv, but also reports whether the variable is set.
+func lookupEnv(env []string, key string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], key+"=") {
+			return env[i][len(key)+1:], true
+		}
+	}
+
+	return "", false
 }
 
 func exitStatus(err error) (int, error) {
@@ -467,16 +668,53 @@ func (d Diagnostics) String() string {
 }
 
 type Shell struct {
+	// Dialect is the shell that runs scripts and interactive sessions.
+	// Defaults to Bash.
+	Dialect ShellDialect
+
+	// Interpreter is the path to the shell interpreter.
+	// Defaults to the dialect's default path, like /bin/bash for Bash.
+	Interpreter string
+
+	// Prompt is the PS1 of interactive sessions.
+	// Defaults to "<appname>$ ", prefixed by "(failed) " while the app fails to build on hot reload.
+	// Use $GOSH_BUILD_STATUS to show it in your own prompt.
+	Prompt string
+
+	// HistFile is the history file of interactive sessions.
+	// Defaults to ~/.<appname>_history, so that each app has its own history.
+	HistFile string
+
+	// UserRC sources the user's rc file like ~/.bashrc at the beginning of interactive sessions.
+	UserRC bool
+
+	// NoErrTrap disables the ERR trap and `set -o errtrace` installed into non-interactive bash,
+	// for the scripts that rely on their own ERR trap not being inherited by functions.
+	// Run then returns ExitError instead of ScriptError for a failed script.
+	NoErrTrap bool
+
 	sync.Mutex
 
-	diags Diagnostics
-	funcs map[string]FunWithOpts
+	// diagsMu guards diags separately, as Diagf is called while holding the lock of the shell
+	diagsMu sync.Mutex
+	diags   Diagnostics
+	funcs   map[string]FunWithOpts
+	sources []string
+	onStart []SessionHook
+	onExit  []SessionHook
+
+	onScriptError []ScriptErrorHook
+
+	// jobsMu guards the jobs started by Start, which finish concurrently
+	jobsMu    sync.Mutex
+	jobs      []*Job
+	lastJobID int
 
 	sync.Once
 
 	app *App
 
-	additionalCallerSkip int
+	config Config
 }
 
 func (t *Shell) Export(args ...interface{}) {
@@ -553,19 +791,39 @@ func (t *Shell) export(name string, fn interface{}, m *reflect.Value, opts []Fun
 }
 
 func (t *Shell) Diagf(format string, args ...interface{}) {
-	_, file, line, _ := runtime.Caller(1)
+	t.diagf(2, format, args...)
+}
+
+// diagf writes the diagnostic annotated with the caller at the depth, where 0 is diagf itself.
+func (t *Shell) diagf(depth int, format string, args ...interface{}) {
+	_, file, line, _ := runtime.Caller(depth)
 
 	callerInfo := fmt.Sprintf("%s:%d\t", filepath.Base(file), line)
 	diag := Diagnostic{Timestamp: time.Now(), Message: callerInfo + fmt.Sprintf(format, args...)}
 
+	t.diagsMu.Lock()
 	t.diags = append(t.diags, diag)
+	t.diagsMu.Unlock()
 
-	diagsOut := os.NewFile(3, "diagnostics")
 	if diagsOut != nil {
 		fmt.Fprintf(diagsOut, "%s\n", diag)
 	}
 }
 
+// diagsOut is the fd 3 inherited from the parent process, if any.
+// It's opened only once on startup, so that it never wraps and closes an fd
+// the Go runtime opened for itself, like the one for epoll.
+var diagsOut = openDiagsOut()
+
+func openDiagsOut() *os.File {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(3, &st); err != nil {
+		return nil
+	}
+
+	return os.NewFile(3, "diagnostics")
+}
+
 func FuncOrMethodToCmdName(f interface{}) string {
 	v := reflect.ValueOf(f)
 	return ReflectValueToCmdName(v)
@@ -593,47 +851,49 @@ func Dep(name string, args ...interface{}) FunOption {
 
 type Command struct {
 	Vars []interface{}
+
+	// stage is the Go func run in the current process instead of Vars, like the one returned by Map
+	stage func(ctx context.Context) error
 }
 
 func Cmd(vars ...interface{}) Command {
 	return Command{Vars: vars}
 }
 
-func (t *Shell) runPipeline(ctx context.Context, cmds []Command) error {
-	precedents, final := cmds[:len(cmds)-1], cmds[len(cmds)-1]
-
-	errs := make([]error, len(cmds))
-
-	var wg sync.WaitGroup
+// Stderr2Stdout returns the command whose stderr is written to its stdout, like `cmd 2>&1`.
+// In a pipeline, the stderr is read by the next command along with the stdout.
+func (c Command) Stderr2Stdout() Command {
+	return c.with(Stderr2Stdout())
+}
 
-	for i := range precedents {
-		i := i
-		var errCh <-chan error
-		ctx, errCh = t.Pipe(ctx, precedents[i].Vars...)
-		wg.Add(1)
-		go func() {
-			errs[i] = <-errCh
-			wg.Done()
-		}()
-	}
+// StdoutToFile returns the command whose stdout is written to the file at path, like `cmd > path`,
+// or `cmd >> path` when append is true.
+func (c Command) StdoutToFile(path string, append bool) Command {
+	return c.with(StdoutFile(path, append))
+}
 
-	var errCh <-chan error
-	errCh = t.GoRun(ctx, final.Vars...)
-	wg.Add(1)
-	go func() {
-		errs[len(cmds)-1] = <-errCh
-		wg.Done()
-	}()
+// StdinFromFile returns the command that reads its stdin from the file at path, like `cmd < path`.
+// In a pipeline, it no longer reads the output of the previous command.
+func (c Command) StdinFromFile(path string) Command {
+	return c.with(StdinFile(path))
+}
 
-	wg.Wait()
+// DiscardStderr returns the command whose stderr is discarded, like `cmd 2>/dev/null`.
+func (c Command) DiscardStderr() Command {
+	return c.with(WriteStderr(ioutil.Discard))
+}
 
-	for i, err := range errs {
-		if err != nil {
-			return fmt.Errorf("command %v at index %d failed: %v", cmds[i].Vars, i, err)
-		}
+// with returns the copy of the command with the options, leaving the original as is.
+func (c Command) with(opts ...RunOption) Command {
+	vars := make([]interface{}, 0, len(c.Vars)+len(opts))
+	vars = append(vars, c.Vars...)
+	for _, o := range opts {
+		vars = append(vars, o)
 	}
 
-	return nil
+	c.Vars = vars
+
+	return c
 }
 
 type Output struct {
@@ -652,6 +912,24 @@ func Env(v ...string) RunOption {
 	}
 }
 
+// CleanEnv runs the command with only the environment variables given by Env, like `env -i` does,
+// so that the command is unaffected by the environment of gosh.
+// The variables gosh sets to call the exported functions, like GOSH_SOCKET, are still set.
+func CleanEnv() RunOption {
+	return func(rc *RunConfig) {
+		rc.CleanEnv = true
+	}
+}
+
+// InheritEnv is like CleanEnv, but the command inherits the environment variables named keys, like:
+//
+//	sh.Run("go", "test", "./...", gosh.InheritEnv("PATH", "HOME"), gosh.Env("CGO_ENABLED=0"))
+func InheritEnv(keys ...string) RunOption {
+	return func(rc *RunConfig) {
+		rc.InheritEnv = append(rc.InheritEnv, keys...)
+	}
+}
+
 func Dir(dir string) RunOption {
 	return func(rc *RunConfig) {
 		rc.Dir = dir
@@ -660,6 +938,10 @@ func Dir(dir string) RunOption {
 
 type StdoutSink struct {
 	w io.Writer
+
+	// path is the file to write to instead of w, which is opened when the command starts
+	path   string
+	append bool
 }
 
 func WriteStdout(w io.Writer) RunOption {
@@ -670,6 +952,50 @@ func WriteStdout(w io.Writer) RunOption {
 	}
 }
 
+// StdoutFile writes the stdout to the file at path, like `> path`, or `>> path` when append is true.
+// A relative path is relative to the working directory of the command.
+func StdoutFile(path string, append bool) RunOption {
+	return func(rc *RunConfig) {
+		rc.Stdout = StdoutSink{
+			path:   path,
+			append: append,
+		}
+	}
+}
+
+// openStdoutFile opens the file given by StdoutFile, if any, and returns the func to close it after the command finished.
+func openStdoutFile(cfg RunConfig, dir string) (RunConfig, func(), error) {
+	if cfg.Stdout.path == "" {
+		return cfg, func() {}, nil
+	}
+
+	path := cfg.Stdout.path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if cfg.Stdout.append {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	cfg.Stdout.w = f
+
+	return cfg, func() { f.Close() }, nil
+}
+
+// Stderr2Stdout writes the stderr to the stdout, like `2>&1`.
+func Stderr2Stdout() RunOption {
+	return func(rc *RunConfig) {
+		rc.Stderr2Stdout = true
+	}
+}
+
 type StderrSink struct {
 	w io.Writer
 }
@@ -682,14 +1008,85 @@ func WriteStderr(w io.Writer) RunOption {
 	}
 }
 
+// StdinSource is the stdin of the command, which is either a reader or a file.
+type StdinSource struct {
+	r    io.Reader
+	path string
+}
+
+// ReadStdin makes the command read its stdin from r.
+func ReadStdin(r io.Reader) RunOption {
+	return func(rc *RunConfig) {
+		rc.Stdin = StdinSource{
+			r: r,
+		}
+	}
+}
+
+// StdinString makes the command read s from its stdin.
+func StdinString(s string) RunOption {
+	return ReadStdin(strings.NewReader(s))
+}
+
+// StdinFile makes the command read its stdin from the file at path.
+// A relative path is relative to the working directory of the command.
+func StdinFile(path string) RunOption {
+	return func(rc *RunConfig) {
+		rc.Stdin = StdinSource{
+			path: path,
+		}
+	}
+}
+
+// withStdin returns the context with the stdin, if any, and the func to close it after the command finished.
+// A relative path to the file is relative to the working directory of the context.
+func withStdin(ctx context.Context, s StdinSource) (context.Context, func(), error) {
+	if s.r != nil {
+		return context.WithStdin(ctx, s.r), func() {}, nil
+	}
+
+	if s.path == "" {
+		return ctx, func() {}, nil
+	}
+
+	path := s.path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(context.Dir(ctx), path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return context.WithStdin(ctx, f), func() { f.Close() }, nil
+}
+
+func (s StdinSource) isSet() bool {
+	return s.r != nil || s.path != ""
+}
+
 type RunOption func(*RunConfig)
 
 type RunConfig struct {
-	Outputs []Output
-	Stdout  StdoutSink
-	Stderr  StderrSink
-	Env     []string
-	Dir     string
+	Outputs         []Output
+	Captures        []Capture
+	Stdin           StdinSource
+	Stdout          StdoutSink
+	Stderr          StderrSink
+	StdoutTees      []io.Writer
+	StderrTees      []io.Writer
+	Combined        io.Writer
+	Prefix          string
+	TimestampLayout string
+	Stderr2Stdout   bool
+	NoPipefail      bool
+	Timeout         time.Duration
+	KillAfter       time.Duration
+	CleanEnv        bool
+	InheritEnv      []string
+	Env             []string
+	Dir             string
 }
 
 func (t *Shell) MustExec(osArgs []string) {
@@ -698,10 +1095,18 @@ func (t *Shell) MustExec(osArgs []string) {
 		args = append(args, a)
 	}
 
-	t.additionalCallerSkip = 1
-
 	if err := t.Run(args...); err != nil {
-		log.Fatal(err)
+		if isBrokenPipe(err) {
+			os.Exit(128 + int(syscall.SIGPIPE))
+		}
+
+		// The failed command has already written its own error to stderr
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) {
+			log.Print(err)
+		}
+
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -744,6 +1149,10 @@ func (t *Shell) Run(vars ...interface{}) error {
 
 	if ctx == nil {
 		ctx = context.Background()
+
+		if shellEffects != nil {
+			ctx = context.WithShellEffects(ctx, shellEffects)
+		}
 	}
 
 	if rc.Stdout.w != nil {
@@ -760,6 +1169,55 @@ func (t *Shell) Run(vars ...interface{}) error {
 
 	t.Diagf("Running %v", args)
 
+	if err := t.init(testCtx, args); err != nil {
+		return err
+	}
+
+	return runWithTimeout(ctx, rc.Timeout, func(ctx context.Context) error {
+		if len(cmds) > 0 {
+			return t.runCommands(ctx, cmds, rc)
+		}
+
+		rc.Env = append(rc.Env, t.app.Env...)
+
+		return t.app.Run(ctx, args, rc)
+	})
+}
+
+// runCommands runs the commands as a pipeline, with the options applied to the whole pipeline.
+func (t *Shell) runCommands(ctx context.Context, cmds []Command, rc RunConfig) error {
+	// Env and Dir apply to all the commands in the pipeline
+	ctx = t.app.withRunConfig(ctx, rc)
+
+	// The first command reads the stdin
+	ctx, closeStdin, err := withStdin(ctx, rc.Stdin)
+	if err != nil {
+		return err
+	}
+	defer closeStdin()
+
+	rc, closeStdout, err := openStdoutFile(rc, context.Dir(ctx))
+	if err != nil {
+		return err
+	}
+	defer closeStdout()
+
+	ctx, explicitStdout, flushOutputs := withOutputs(ctx, rc)
+	defer flushOutputs()
+
+	// and the last command writes the stdout
+	ctx, decodeCaptures := withCaptures(ctx, rc.Captures, explicitStdout)
+
+	if err := t.runPipeline(ctx, cmds, !rc.NoPipefail); err != nil {
+		return err
+	}
+
+	return decodeCaptures()
+}
+
+// init initializes the app on the first call to Run or Session.
+// testCtx and args are the ones passed to the first call.
+func (t *Shell) init(testCtx *testing.T, args []interface{}) error {
 	var initErr error
 
 	t.Once.Do(func() {
@@ -770,20 +1228,23 @@ func (t *Shell) Run(vars ...interface{}) error {
 			return
 		}
 
-		dir, err := os.Getwd()
+		dir, err := filepath.Abs(t.config.Dir)
 		if err != nil {
-			println(err.Error())
 			initErr = err
 			return
 		}
 
-		// Without sync.Once, the number should be 1
-		_, filename, _, _ := runtime.Caller(4 + t.additionalCallerSkip)
-
-		var pkg string
+		pkg := t.config.Pkg
+		if pkg == "" {
+			pkg = mainPkg()
+		} else if pkg, err = filepath.Abs(pkg); err != nil {
+			initErr = err
+			return
+		}
 
-		if _, err := os.Stat(filename); err == nil {
-			pkg = filepath.Dir(filename)
+		trigger := t.config.TriggerArg
+		if trigger == "" {
+			trigger = DefaultTriggerArg
 		}
 
 		var selfArgs []string
@@ -822,15 +1283,32 @@ func (t *Shell) Run(vars ...interface{}) error {
 			}
 		}
 
+		sources, err := resolveSources(dir, t.sources)
+		if err != nil {
+			initErr = err
+			return
+		}
+
 		t.app = &App{
 			funcs:      t.funcs,
+			shell:      t,
 			Pkg:        pkg,
-			BashPath:   "/bin/bash",
+			BuildTags:  t.config.buildTags(),
+			BuildFlags: t.config.BuildFlags,
+			BashPath:   t.Interpreter,
+			Dialect:    t.Dialect,
 			Dir:        dir,
-			TriggerArg: ":::",
+			TriggerArg: trigger,
 			SelfPath:   ex,
 			SelfArgs:   selfArgs,
 			Env:        env,
+			Sources:    sources,
+
+			Interactive:   t.interactiveConfig(),
+			OnStart:       t.onStart,
+			OnExit:        t.onExit,
+			OnScriptError: t.onScriptError,
+			NoErrTrap:     t.NoErrTrap,
 		}
 	})
 
@@ -842,13 +1320,7 @@ func (t *Shell) Run(vars ...interface{}) error {
 		return fmt.Errorf("[bug] app is not initialized")
 	}
 
-	if len(cmds) > 0 {
-		return t.runPipeline(ctx, cmds)
-	}
-
-	rc.Env = append(rc.Env, t.app.Env...)
-
-	return t.app.Run(ctx, args, rc)
+	return nil
 }
 
 func (c *App) Dep(args ...interface{}) error {
@@ -863,8 +1335,11 @@ func (c *App) DepStringMap(args ...interface{}) (map[string]string, error) {
 	return nil, nil
 }
 
+// GoRun runs the command in a goroutine, and sends the error to the returned channel once it finished.
+// See Start for the handle to wait for, signal, and read the output of the command.
 func (sh *Shell) GoRun(ctx context.Context, vars ...interface{}) <-chan error {
-	err := make(chan error)
+	// Buffered so that the goroutine never leaks when nobody reads it
+	err := make(chan error, 1)
 
 	go func() {
 		vars = append([]interface{}{ctx}, vars...)
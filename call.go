@@ -106,6 +106,11 @@ FOR:
 				return nil, fmt.Errorf("parameter %v at %d is not supported", in_typeName, i)
 			}
 		case reflect.Interface:
+			if inV == contextType {
+				args[i] = reflect.ValueOf(newContext(ctx, funArgs))
+				break
+			}
+
 			// if inV != reflectTypeContext {
 			// 	panic(fmt.Errorf("param %d is interface but not %v", i, reflectTypeContext))
 			// }
@@ -0,0 +1,125 @@
+package gosh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// maxOutputSnippet is the max number of bytes of the output included in the error on decoding it
+const maxOutputSnippet = 256
+
+// Capture decodes the stdout captured from the command into a Go value.
+// It's called only when the command succeeded.
+type Capture func(out []byte) error
+
+// OutString captures the stdout into s, with the leading and trailing whitespaces trimmed, like:
+//
+//	var current string
+//	sh.Run("kubectl", "config", "current-context", gosh.OutString(&current))
+//
+// Unlike Out, which receives the return value of an exported Go function,
+// it works for both Go functions and external commands.
+func OutString(s *string) RunOption {
+	return capture(func(out []byte) error {
+		*s = strings.TrimSpace(string(out))
+
+		return nil
+	})
+}
+
+// OutLines captures the stdout into lines, without the trailing newline.
+// It's empty when the command wrote nothing.
+func OutLines(lines *[]string) RunOption {
+	return capture(func(out []byte) error {
+		s := strings.TrimSuffix(string(out), "\n")
+		if s == "" {
+			*lines = nil
+			return nil
+		}
+
+		*lines = strings.Split(s, "\n")
+
+		return nil
+	})
+}
+
+// OutJSON captures the stdout, and decodes it as JSON into v, which needs to be a pointer.
+func OutJSON(v interface{}) RunOption {
+	return capture(func(out []byte) error {
+		if err := json.Unmarshal(out, v); err != nil {
+			return fmt.Errorf("decoding output as JSON into %T: %w (output: %s)", v, err, outputSnippet(out))
+		}
+
+		return nil
+	})
+}
+
+func capture(c Capture) RunOption {
+	return func(rc *RunConfig) {
+		rc.Captures = append(rc.Captures, c)
+	}
+}
+
+// withCaptures returns the context whose stdout is captured for captures, and the func to decode the output
+// after the command succeeded.
+// The stdout is still written to tee, if any, so that you can both capture and see it.
+func withCaptures(ctx context.Context, captures []Capture, tee io.Writer) (context.Context, func() error) {
+	if len(captures) == 0 {
+		return ctx, func() error { return nil }
+	}
+
+	buf := &captureBuffer{}
+
+	var w io.Writer = buf
+	if tee != nil {
+		w = io.MultiWriter(buf, tee)
+	}
+
+	decode := func() error {
+		for _, c := range captures {
+			if err := c(buf.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return context.WithStdout(ctx, w), decode
+}
+
+// captureBuffer is a buffer safe for concurrent writes,
+// as the functions called by a shell may write to the same stdout concurrently.
+type captureBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *captureBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Bytes()
+}
+
+// outputSnippet returns the beginning of the output for the error message.
+func outputSnippet(out []byte) string {
+	if len(out) > maxOutputSnippet {
+		return fmt.Sprintf("%q...", out[:maxOutputSnippet])
+	}
+
+	return fmt.Sprintf("%q", out)
+}
@@ -0,0 +1,63 @@
+package gosh_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapture(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("pods", func(ctx gosh.Context) {
+		fmt.Fprintln(ctx.Stdout(), `{"items": [{"name": "foo"}, {"name": "bar"}]}`)
+	})
+
+	type pods struct {
+		Items []struct {
+			Name string `json:"name"`
+		} `json:"items"`
+	}
+
+	goshtest.Run(t, sh, func() {
+		var s string
+
+		assert.NoError(t, sh.Run(t, "echo", "  hello  ", gosh.OutString(&s)))
+		assert.Equal(t, "hello", s)
+
+		var lines []string
+
+		assert.NoError(t, sh.Run(t, "printf", `a\nb\n\nc\n`, gosh.OutLines(&lines)))
+		assert.Equal(t, []string{"a", "b", "", "c"}, lines)
+
+		assert.NoError(t, sh.Run(t, "true", gosh.OutLines(&lines)))
+		assert.Empty(t, lines)
+
+		var fromGo, fromShell pods
+
+		assert.NoError(t, sh.Run(t, "pods", gosh.OutJSON(&fromGo)))
+		assert.NoError(t, sh.Run(t, "bash", "-c", "pods", gosh.OutJSON(&fromShell)))
+
+		for _, p := range []pods{fromGo, fromShell} {
+			if assert.Len(t, p.Items, 2) {
+				assert.Equal(t, "foo", p.Items[0].Name)
+				assert.Equal(t, "bar", p.Items[1].Name)
+			}
+		}
+
+		// Captured and written to the sink
+		var stdout bytes.Buffer
+
+		assert.NoError(t, sh.Run(t, gosh.Cmd("pods"), gosh.Cmd("grep", "-o", "foo"), gosh.OutString(&s), gosh.WriteStdout(&stdout)))
+		assert.Equal(t, "foo", s)
+		assert.Equal(t, "foo\n", stdout.String())
+
+		err := sh.Run(t, "echo", "not json", gosh.OutJSON(&fromGo))
+
+		assert.EqualError(t, err, `decoding output as JSON into *gosh_test.pods: invalid character 'o' in literal null (expecting 'u') (output: "not json\n")`)
+	})
+}
@@ -0,0 +1,110 @@
+package gosh
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// Script is a shell script to be interpreted by the shell, like Script("kubectl get po | grep foo").
+//
+// Any other string passed to Run is a single argument that the shell never interprets,
+// so that `$`, backticks and `\` in it are passed to the command as is.
+// Pass a Script as the first arg to run it, followed by the positional parameters like $1 and $2 of the script.
+type Script string
+
+// runScript runs the script in the shell, with args as the positional parameters.
+func (c *App) runScript(ctx context.Context, script string, args []string, cfg RunConfig) (int, error) {
+	// The first arg after the script is $0
+	return c.runInternal(ctx, false, append([]string{"-c", script, appName()}, args...), cfg)
+}
+
+// lookPath returns the path to the external command named name,
+// if it can be run directly without the shell.
+// It returns false when it's a shell function or a shell builtin, which needs the shell to run.
+func (c *App) lookPath(ctx context.Context, name string) (string, bool, error) {
+	if isShellFunc, err := c.isShellFunc(ctx, name); err != nil || isShellFunc {
+		return "", false, err
+	}
+
+	// exec.LookPath can't see the PATH overridden for the command.
+	// Let the shell find it instead.
+	if getenv(context.Environ(ctx), "PATH") != os.Getenv("PATH") {
+		return "", false, nil
+	}
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", false, nil
+	}
+
+	return path, true, nil
+}
+
+// runCommand runs the external command at path directly without the shell.
+// The shims of the exported functions are put on PATH, so that the command is still able to call them.
+func (c *App) runCommand(ctx context.Context, path string, args []string, cfg RunConfig) (int, error) {
+	shims, err := c.writeShims()
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(shims)
+
+	// The shell run as the command, like `bash -c '...'`, still loads the env file,
+	// so that it gets the functions that modify it and the ones in the sources, rather than only the shims
+	envfile, err := c.buildEnvfile(ctx, false)
+	if err != nil {
+		return 0, err
+	}
+	if !c.Debug {
+		defer os.Remove(envfile)
+	}
+
+	dispatcher, err := c.startDispatcher(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer dispatcher.Close()
+
+	_, shellEnv := c.dialect().Command(envfile, false, nil)
+
+	// An empty entry, like the trailing one of `<shims>:`, would search the working directory
+	pathEnv := shims
+	if inherited := getenv(context.Environ(ctx), "PATH"); inherited != "" {
+		pathEnv += string(os.PathListSeparator) + inherited
+	}
+
+	env := []string{
+		"SELF=" + os.Args[0],
+		"SELF_ARGS=" + strings.Join(c.SelfArgs, " "),
+		"SELF_EXECUTABLE=" + c.SelfPath,
+		"PATH=" + pathEnv,
+	}
+
+	env = append(env, shellEnv...)
+
+	cmd := c.command(ctx, dispatcher, path, args, env)
+
+	return exitStatus(runProcess(ctx, cmd, false, killAfter(ctx)))
+}
+
+// writeShims writes the shims of the exported functions into a temporary directory, and returns the directory.
+func (c *App) writeShims() (string, error) {
+	dir, err := ioutil.TempDir("", "gosh-shims")
+	if err != nil {
+		return "", err
+	}
+
+	for name := range c.funcs {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(c.dialect().Shim(c.TriggerArg, name)), 0755); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
@@ -0,0 +1,58 @@
+package gosh_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/context"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommand(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("hello", func(ctx context.Context, target string) {
+		context.Stdout(ctx).Write([]byte("hello " + target + "\n"))
+	})
+
+	goshtest.Run(t, sh, func() {
+		t.Run("args are never interpreted", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			err := sh.Run(t, "echo", "$HOME", "`pwd`", `a\b`, "'quoted'", `"double"`, gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "$HOME `pwd` a\\b 'quoted' \"double\"\n", stdout.String())
+		})
+
+		t.Run("shell builtin", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			// `builtin` isn't on PATH, so it's run by the shell
+			err := sh.Run(t, "builtin", "echo", "$HOME", "`pwd`", `a\b`, "'quoted'", gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "$HOME `pwd` a\\b 'quoted'\n", stdout.String())
+		})
+
+		t.Run("external command calling exported function", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			err := sh.Run(t, "xargs", "hello", gosh.WriteStdout(&stdout), context.WithStdin(context.Background(), bytes.NewBufferString("world\n")))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "hello world\n", stdout.String())
+		})
+
+		t.Run("script", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			err := sh.Run(t, gosh.Script(`for a in "$@"; do hello "$a"; done | grep -v bar`), "foo", "bar", gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "hello foo\n", stdout.String())
+		})
+	})
+}
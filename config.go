@@ -0,0 +1,117 @@
+package gosh
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+const (
+	// DefaultTriggerArg is the arg that precedes the function call in the args to the application, unless configured otherwise.
+	DefaultTriggerArg = ":::"
+
+	// buildTagEnv is the envvar to specify the build tags to rebuild the application with, unless configured otherwise
+	buildTagEnv = "GOSH_BUILD_TAG"
+)
+
+// Config configures the Shell created by New.
+// The zero value is valid, and is what a zero-value Shell uses.
+type Config struct {
+	// Pkg is the directory of the main package of the application, rebuilt on hot reload.
+	// Defaults to the directory of the source file that defines the main function, if it exists on this machine.
+	Pkg string
+
+	// BuildTags are the build tags to rebuild the application with, like []string{"project"}.
+	// Go has no way to expose the build tags at runtime, so you need to specify them here
+	// if the application is built with any.
+	// Defaults to the comma-separated tags in $GOSH_BUILD_TAG.
+	BuildTags []string
+
+	// BuildFlags are the additional flags to rebuild the application with,
+	// like []string{"-ldflags=-X main.version=dev"}.
+	BuildFlags []string
+
+	// BashPath is the path to the shell interpreter, which is set to Shell.Interpreter.
+	// Defaults to the dialect's default path, like /bin/bash for Bash.
+	BashPath string
+
+	// Dir is the working directory of the shells spawned by gosh.
+	// Defaults to the current working directory.
+	Dir string
+
+	// TriggerArg is the arg that precedes the function call in the args to the application.
+	// Defaults to DefaultTriggerArg.
+	TriggerArg string
+}
+
+// New returns a Shell configured with c.
+func New(c Config) *Shell {
+	return &Shell{
+		Interpreter: c.BashPath,
+		config:      c,
+	}
+}
+
+// buildTags returns the build tags to rebuild the application with.
+func (c Config) buildTags() []string {
+	if len(c.BuildTags) > 0 {
+		return c.BuildTags
+	}
+
+	if tags := os.Getenv(buildTagEnv); tags != "" {
+		return strings.Split(tags, ",")
+	}
+
+	return nil
+}
+
+// mainPkg returns the directory of the main package, by looking for the main function in the call stack.
+// When it's called from another goroutine than the main one, like in Parallel, the main package is looked up
+// from the build info instead.
+// It returns an empty string when it isn't found, like when the application is built elsewhere or run as a test.
+func mainPkg() string {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(1, pcs)])
+
+	for {
+		f, more := frames.Next()
+
+		// The main function of a test binary is generated into a temporary directory
+		if f.Function == "main.main" && filepath.Base(f.File) != "_testmain.go" {
+			if _, err := os.Stat(f.File); err != nil {
+				return ""
+			}
+
+			return filepath.Dir(f.File)
+		} else if f.Function == "main.main" {
+			return ""
+		}
+
+		if !more {
+			return mainPkgFromBuildInfo()
+		}
+	}
+}
+
+// mainPkgFromBuildInfo returns the directory of the main package by running `go list` on the import path of it.
+// It returns an empty string when it isn't found, like when the application is built from files rather than a package.
+func mainPkgFromBuildInfo() string {
+	if strings.HasSuffix(os.Args[0], ".test") {
+		return ""
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Path == "" || info.Path == "command-line-arguments" {
+		return ""
+	}
+
+	out, err := exec.Command("go", "list", "-f", "{{.Dir}}", info.Path).Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,40 @@
+package gosh_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/context"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sh := gosh.New(gosh.Config{
+		Dir:        dir,
+		TriggerArg: "--call",
+		BashPath:   "/bin/bash",
+	})
+
+	assert.Equal(t, "/bin/bash", sh.Interpreter)
+
+	sh.Export("wd", func(ctx context.Context) {
+		context.Stdout(ctx).Write([]byte(context.Dir(ctx) + "\n"))
+	})
+
+	goshtest.Run(t, sh, func() {
+		var stdout bytes.Buffer
+
+		err := sh.Run(t, "bash", "-c", "wd; pwd", gosh.WriteStdout(&stdout))
+
+		assert.NoError(t, err)
+		assert.Equal(t, dir+"\n"+dir+"\n", stdout.String())
+	})
+}
@@ -2,6 +2,7 @@ package context
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"os"
 )
@@ -11,12 +12,18 @@ type Context = context.Context
 var TODO = context.TODO
 var Background = context.Background
 var WithValue = context.WithValue
+var WithCancel = context.WithCancel
+var WithTimeout = context.WithTimeout
+var DeadlineExceeded = context.DeadlineExceeded
+var Canceled = context.Canceled
 
 type stdinKey struct{}
 type stdoutKey struct{}
 type stderrKey struct{}
 type errorKey struct{}
 type varsKey struct{}
+type dirKey struct{}
+type environKey struct{}
 
 func WithStdin(ctx context.Context, in io.Reader) Context {
 	return context.WithValue(ctx, stdinKey{}, in)
@@ -57,6 +64,42 @@ func Stderr(ctx context.Context) io.Writer {
 	return v.(io.Writer)
 }
 
+func WithDir(ctx context.Context, dir string) Context {
+	return context.WithValue(ctx, dirKey{}, dir)
+}
+
+func Dir(ctx context.Context) string {
+	dir, ok := LookupDir(ctx)
+	if !ok {
+		dir, _ = os.Getwd()
+	}
+
+	return dir
+}
+
+// LookupDir returns the working directory set to the context, if any.
+func LookupDir(ctx context.Context) (string, bool) {
+	v := ctx.Value(dirKey{})
+	if v == nil {
+		return "", false
+	}
+
+	return v.(string), true
+}
+
+func WithEnviron(ctx context.Context, env []string) Context {
+	return context.WithValue(ctx, environKey{}, env)
+}
+
+func Environ(ctx context.Context) []string {
+	v := ctx.Value(environKey{})
+	if v == nil {
+		return os.Environ()
+	}
+
+	return v.([]string)
+}
+
 func WithError(ctx context.Context, err error) Context {
 	return context.WithValue(ctx, errorKey{}, err)
 }
@@ -74,6 +117,8 @@ func WithVariables(ctx context.Context, vars map[string]interface{}) Context {
 	return context.WithValue(ctx, varsKey{}, &Variables{vars: vars})
 }
 
+// Get returns the variable named key, or nil if it isn't set.
+// Prefer Key, which saves you from asserting the type of the value.
 func Get(ctx context.Context, key string) interface{} {
 	vars := getVars(ctx)
 	if vars == nil {
@@ -83,6 +128,8 @@ func Get(ctx context.Context, key string) interface{} {
 	return vars.Get(key)
 }
 
+// Set sets the variable named key in the current scope.
+// Prefer Key, which saves you from asserting the type of the value.
 func Set(ctx context.Context, key string, value interface{}) {
 	vars := getVars(ctx)
 	if vars == nil {
@@ -92,6 +139,18 @@ func Set(ctx context.Context, key string, value interface{}) {
 	vars.Set(key, value)
 }
 
+// Export copies the variable named key in the current scope to the scope of the caller,
+// like a dependency added with gosh.Dep does to make the variable visible to the dependent function.
+// Prefer Key, which saves you from asserting the type of the value.
+func Export(ctx context.Context, key string) error {
+	vars := getVars(ctx)
+	if vars == nil {
+		return fmt.Errorf("unable to export %q: no scope of variables in the context", key)
+	}
+
+	return vars.Export(key)
+}
+
 func getVars(ctx context.Context) *Variables {
 	v := ctx.Value(varsKey{})
 	if v == nil {
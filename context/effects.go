@@ -0,0 +1,68 @@
+package context
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Shell effects are the changes a Go function makes to the shell that called it,
+// like setting envvars and changing the working directory.
+// They are written as shell statements to a side-channel, which is then evaluated by the shell
+// after the function returns.
+
+type shellEffectsKey struct{}
+
+var shellVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func WithShellEffects(ctx context.Context, w io.Writer) Context {
+	return context.WithValue(ctx, shellEffectsKey{}, w)
+}
+
+// SetShellEnv exports the envvar to the calling shell.
+func SetShellEnv(ctx context.Context, name, value string) error {
+	if !shellVarName.MatchString(name) {
+		return fmt.Errorf("invalid envvar name %q", name)
+	}
+
+	return writeShellEffect(ctx, "export "+name+"="+quote(value))
+}
+
+// SetShellVar sets the shell variable in the calling shell, without exporting it.
+func SetShellVar(ctx context.Context, name, value string) error {
+	if !shellVarName.MatchString(name) {
+		return fmt.Errorf("invalid shell variable name %q", name)
+	}
+
+	return writeShellEffect(ctx, name+"="+quote(value))
+}
+
+// Chdir changes the working directory of the calling shell.
+// A relative dir is resolved against the working directory of the caller.
+func Chdir(ctx context.Context, dir string) error {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(Dir(ctx), dir)
+	}
+
+	return writeShellEffect(ctx, "cd "+quote(dir))
+}
+
+func writeShellEffect(ctx context.Context, stmt string) error {
+	v := ctx.Value(shellEffectsKey{})
+	if v == nil {
+		return fmt.Errorf("unable to run `%s`: not called from a shell", stmt)
+	}
+
+	if _, err := fmt.Fprintln(v.(io.Writer), stmt); err != nil {
+		return fmt.Errorf("unable to run `%s` in the calling shell: %w", stmt, err)
+	}
+
+	return nil
+}
+
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package context
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockShared locks the file for reading until it's closed.
+func lockShared(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+}
+
+// lockExclusive locks the file for writing until it's closed.
+func lockExclusive(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
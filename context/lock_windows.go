@@ -0,0 +1,33 @@
+package context
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const lockfileExclusiveLock = 0x2
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// lockShared locks the file for reading until it's closed.
+func lockShared(f *os.File) error {
+	return lockFileEx(f, 0)
+}
+
+// lockExclusive locks the file for writing until it's closed.
+func lockExclusive(f *os.File) error {
+	return lockFileEx(f, lockfileExclusiveLock)
+}
+
+// lockFileEx locks the whole file, waiting for the other processes to unlock it.
+func lockFileEx(f *os.File, flags uint32) error {
+	var overlapped syscall.Overlapped
+
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, 0xffffffff, 0xffffffff, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		return err
+	}
+
+	return nil
+}
@@ -1,9 +1,26 @@
 package context
 
-import "sync"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
 
+// VarsFileEnv is the name of the envvar that points to the file persisting the variables declared with
+// NewSessionKey, which is set by gosh to the shell session.
+const VarsFileEnv = "GOSH_VARS_FILE"
+
+// Variables is a scope of variables.
+// Each call to an exported function gets its own scope nested in the scope of the caller,
+// so that the variables set by the function are invisible to the caller unless exported.
 type Variables struct {
-	sync.Mutex
+	sync.RWMutex
+
+	parent *Variables
 
 	vars map[string]interface{}
 }
@@ -19,6 +36,286 @@ func (c *Variables) Set(k string, v interface{}) {
 	c.vars[k] = v
 }
 
+// Get returns the variable from the scope, or from the closest outer scope that has it.
 func (c *Variables) Get(k string) interface{} {
-	return c.vars[k]
+	v, _ := c.Lookup(k)
+
+	return v
+}
+
+// Lookup is like Get, but also reports whether the variable is set.
+func (c *Variables) Lookup(k string) (interface{}, bool) {
+	for s := c; s != nil; s = s.parent {
+		s.RLock()
+		v, ok := s.vars[k]
+		s.RUnlock()
+
+		if ok {
+			return v, true
+		}
+	}
+
+	return nil, false
+}
+
+// Export copies the variable in the scope to the outer scope.
+func (c *Variables) Export(k string) error {
+	if c.parent == nil {
+		return fmt.Errorf("unable to export %q: no outer scope", k)
+	}
+
+	c.RLock()
+	v, ok := c.vars[k]
+	c.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("unable to export %q: not set in the current scope", k)
+	}
+
+	c.parent.Set(k, v)
+
+	return nil
+}
+
+// root returns the outermost scope.
+func (c *Variables) root() *Variables {
+	s := c
+	for s.parent != nil {
+		s = s.parent
+	}
+
+	return s
+}
+
+// WithScope returns the context with a new scope of variables nested in the current one, if any.
+func WithScope(ctx context.Context) Context {
+	return context.WithValue(ctx, varsKey{}, &Variables{parent: getVars(ctx)})
+}
+
+// HasScope reports whether the context has a scope of variables.
+func HasScope(ctx context.Context) bool {
+	return getVars(ctx) != nil
+}
+
+// Key is the typed key of a variable, like:
+//
+//	var clusterName = context.NewKey[string]("cluster-name")
+//
+//	clusterName.Set(ctx, "dev")
+//	name := clusterName.Get(ctx)
+type Key[T any] struct {
+	name string
+}
+
+// NewKey returns the key of the variable named name.
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{name: name}
+}
+
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+// Get returns the value of the variable, or the zero value if it isn't set.
+func (k Key[T]) Get(ctx context.Context) T {
+	v, _ := k.Lookup(ctx)
+
+	return v
+}
+
+// Lookup returns the value of the variable, and reports whether it's set.
+func (k Key[T]) Lookup(ctx context.Context) (T, bool) {
+	vars := getVars(ctx)
+	if vars == nil {
+		var zero T
+		return zero, false
+	}
+
+	return lookup[T](vars, k.name)
+}
+
+// Set sets the variable in the current scope.
+func (k Key[T]) Set(ctx context.Context, v T) error {
+	vars := getVars(ctx)
+	if vars == nil {
+		return fmt.Errorf("unable to set %q: no scope of variables in the context", k.name)
+	}
+
+	vars.Set(k.name, v)
+
+	return nil
+}
+
+// Export copies the variable in the current scope to the scope of the caller.
+func (k Key[T]) Export(ctx context.Context) error {
+	return Export(ctx, k.name)
+}
+
+// SessionKey is the typed key of a session variable, which is global to the shell session, like:
+//
+//	var currentUser = context.NewSessionKey[string]("user")
+//
+//	currentUser.Set(ctx, "alice")
+//	name := currentUser.Get(ctx)
+//
+// Unlike the variable of Key, it isn't scoped.
+// Once set, it's visible to all the subsequent calls to exported functions within the session,
+// including the callers and the nested shells, even when the calls are handled by different processes, like after a hot reload.
+// Outside of a shell session, it's global to the outermost scope of the context.
+type SessionKey[T any] struct {
+	name string
+}
+
+// NewSessionKey returns the key of the session variable named name.
+// The value needs to be encodable to JSON.
+func NewSessionKey[T any](name string) SessionKey[T] {
+	return SessionKey[T]{name: name}
+}
+
+func (k SessionKey[T]) Name() string {
+	return k.name
+}
+
+// Get returns the value of the variable, or the zero value if it isn't set.
+func (k SessionKey[T]) Get(ctx context.Context) T {
+	v, _ := k.Lookup(ctx)
+
+	return v
+}
+
+// Lookup returns the value of the variable, and reports whether it's set.
+// It's read from the session, as it may have been set by another process.
+func (k SessionKey[T]) Lookup(ctx context.Context) (T, bool) {
+	var v T
+
+	if path := varsFile(ctx); path != "" {
+		ok, err := readVar(path, k.name, &v)
+
+		return v, err == nil && ok
+	}
+
+	vars := getVars(ctx)
+	if vars == nil {
+		return v, false
+	}
+
+	return lookup[T](vars.root(), k.name)
+}
+
+// Set sets the variable in the session.
+func (k SessionKey[T]) Set(ctx context.Context, v T) error {
+	if path := varsFile(ctx); path != "" {
+		if err := writeVar(path, k.name, v); err != nil {
+			return fmt.Errorf("unable to persist %q: %w", k.name, err)
+		}
+
+		return nil
+	}
+
+	vars := getVars(ctx)
+	if vars == nil {
+		return fmt.Errorf("unable to set %q: no scope of variables in the context", k.name)
+	}
+
+	vars.root().Set(k.name, v)
+
+	return nil
+}
+
+// lookup returns the variable of the type T from the scope, or from the closest outer scope that has it.
+func lookup[T any](vars *Variables, name string) (T, bool) {
+	v, ok := vars.Lookup(name)
+	if !ok {
+		var zero T
+		return zero, false
+	}
+
+	typed, ok := v.(T)
+
+	return typed, ok
+}
+
+func varsFile(ctx context.Context) string {
+	env := Environ(ctx)
+
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], VarsFileEnv+"=") {
+			return env[i][len(VarsFileEnv)+1:]
+		}
+	}
+
+	return ""
+}
+
+// readVar reads the variable from the file, which is locked so that a concurrent writer in another process
+// never exposes a partially written file.
+func readVar(path, name string, v interface{}) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if err := lockShared(f); err != nil {
+		return false, err
+	}
+
+	vars := map[string]json.RawMessage{}
+	if err := json.NewDecoder(f).Decode(&vars); err == io.EOF {
+		// Created but not yet written
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	raw, ok := vars[name]
+	if !ok {
+		return false, nil
+	}
+
+	return true, json.Unmarshal(raw, v)
+}
+
+func writeVar(path, name string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockExclusive(f); err != nil {
+		return err
+	}
+
+	vars := map[string]json.RawMessage{}
+
+	if st, err := f.Stat(); err != nil {
+		return err
+	} else if st.Size() > 0 {
+		if err := json.NewDecoder(f).Decode(&vars); err != nil {
+			return err
+		}
+	}
+
+	vars[name] = raw
+
+	bs, err := json.Marshal(vars)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(bs, 0)
+
+	return err
 }
@@ -0,0 +1,115 @@
+package context_test
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mumoshu/gosh/context"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKey(t *testing.T) {
+	name := context.NewKey[string]("name")
+	count := context.NewKey[int]("count")
+
+	root := context.WithScope(context.Background())
+
+	assert.NoError(t, name.Set(root, "root"))
+
+	child := context.WithScope(root)
+
+	assert.Equal(t, "root", name.Get(child))
+
+	_, ok := count.Lookup(child)
+	assert.False(t, ok)
+
+	assert.NoError(t, name.Set(child, "child"))
+	assert.NoError(t, count.Set(child, 1))
+
+	assert.Equal(t, "child", name.Get(child))
+	assert.Equal(t, "root", name.Get(root))
+
+	// Only the exported variable is visible to the outer scope
+	assert.NoError(t, count.Export(child))
+	assert.Equal(t, 1, count.Get(root))
+	assert.Equal(t, "root", name.Get(root))
+
+	assert.Error(t, count.Export(root))
+
+	// The untyped variables are exported alike
+	context.Set(child, "untyped", true)
+	assert.NoError(t, context.Export(child, "untyped"))
+	assert.Equal(t, true, context.Get(root, "untyped"))
+	assert.Error(t, context.Export(child, "missing"))
+
+	// A variable of another type is never returned
+	_, ok = context.NewKey[bool]("count").Lookup(root)
+	assert.False(t, ok)
+
+	assert.Error(t, name.Set(context.Background(), "none"))
+}
+
+func TestKeyConcurrency(t *testing.T) {
+	count := context.NewKey[int]("count")
+
+	ctx := context.WithScope(context.Background())
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		i := i
+
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			count.Set(ctx, i)
+		}()
+
+		go func() {
+			defer wg.Done()
+			count.Get(ctx)
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestSessionKey(t *testing.T) {
+	type cluster struct {
+		Name  string
+		Nodes int
+	}
+
+	key := context.NewSessionKey[cluster]("cluster")
+	other := context.NewSessionKey[string]("other")
+
+	env := []string{context.VarsFileEnv + "=" + filepath.Join(t.TempDir(), "vars.json")}
+
+	first := context.WithScope(context.WithEnviron(context.Background(), env))
+
+	_, ok := key.Lookup(first)
+	assert.False(t, ok)
+
+	assert.NoError(t, key.Set(first, cluster{Name: "dev", Nodes: 3}))
+	assert.NoError(t, other.Set(context.WithScope(first), "foo"))
+
+	// Another call in the session, which may be handled by another process
+	second := context.WithScope(context.WithEnviron(context.Background(), env))
+
+	assert.Equal(t, cluster{Name: "dev", Nodes: 3}, key.Get(second))
+	assert.Equal(t, "foo", other.Get(second))
+
+	// Without the session, it's global to the outermost scope
+	root := context.WithScope(context.Background())
+	child := context.WithScope(root)
+
+	assert.NoError(t, other.Set(child, "bar"))
+	assert.Equal(t, "bar", other.Get(root))
+	assert.Equal(t, "foo", other.Get(second))
+
+	// It never collides with the scoped variable of the same name
+	_, ok = context.NewKey[string]("other").Lookup(second)
+	assert.False(t, ok)
+}
@@ -0,0 +1,274 @@
+package gosh
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ShellDialect abstracts away the differences among shells,
+// so that gosh can generate the env/rc script, function shims and interpreter invocations for each of them.
+type ShellDialect interface {
+	// Name is the name of the shell, like "bash"
+	Name() string
+
+	// DefaultPath is the path to the interpreter used when none is configured
+	DefaultPath() string
+
+	// Preamble is written at the top of the env/rc script.
+	Preamble() string
+
+	// Shim returns the content of the executable that calls the exported function via the gosh application.
+	// trigger is the arg that precedes the function name in the args to the application, like ":::".
+	Shim(trigger, name string) string
+
+	// Function returns the definition of the shell function that calls the exported function via the gosh application,
+	// and evaluates the shell effects written to the fd denoted by $GOSH_EFFECTS_FD after the call.
+	Function(trigger, name string) string
+
+	// ListFunctions returns a script that prints the names of the defined shell functions, one per line.
+	// Each line may be prefixed by anything separated by whitespaces, as the last field is used as the name.
+	// It returns an empty string if the shell has no way to list them.
+	ListFunctions() string
+
+	// ReloadHook returns a script that asks the active binary to reload the application before every command
+	// in an interactive session, and defines the builtin function to force it unless builtin is empty.
+	// It returns an empty string if the shell has no way to run it.
+	ReloadHook(builtin string) string
+
+	// ErrTrap returns the script that reports every failed command to the fd denoted by $GOSH_DIAGNOSTICS_FD
+	// in non-interactive sessions, formatted as described in scriptErrorPrefix.
+	// It returns an empty string if the shell has no way to trap them.
+	ErrTrap() string
+
+	// InteractiveRC returns the script to customize an interactive session, run before the env is loaded.
+	InteractiveRC(c InteractiveConfig) string
+
+	// Command returns the interpreter args and additional envvars to run args with envfile being loaded.
+	// args are either empty, `-c <script>`, or a path to the script file followed by its args.
+	Command(envfile string, interactive bool, args []string) ([]string, []string)
+}
+
+var (
+	// Bash is the default shell dialect
+	Bash ShellDialect = bashDialect{}
+
+	// Sh is the dialect for POSIX sh implementations like dash.
+	// Note that it doesn't support hot reloading as POSIX sh has no hook to run a command before every command.
+	Sh ShellDialect = shDialect{}
+)
+
+type bashDialect struct{}
+
+func (bashDialect) Name() string {
+	return "bash"
+}
+
+func (bashDialect) DefaultPath() string {
+	return "/bin/bash"
+}
+
+func (bashDialect) Preamble() string {
+	// unset for future calls to bash
+	return "unset BASH_ENV\n"
+}
+
+func (bashDialect) Shim(trigger, name string) string {
+	return `#!/usr/bin/env bash
+` + callFunc(trigger, name) + `
+`
+}
+
+func (bashDialect) Function(trigger, name string) string {
+	return `
+` + name + ` () {
+local _gosh_effects
+{ _gosh_effects=$(` + shellEffectsFDEnv + `=4 ` + callFunc(trigger, name) + ` 4>&1 1>&5 5>&-; echo "return $?"); } 5>&1
+eval "$_gosh_effects"
+}
+export -f ` + name + `
+`
+}
+
+func (bashDialect) ListFunctions() string {
+	// Prints `declare -f name` for each function
+	return "declare -F\n"
+}
+
+func (bashDialect) ReloadHook(builtin string) string {
+	hook := `
+_gosh_reload () {
+eval "$($SELF_EXECUTABLE $SELF_ARGS ` + reloadArg + ` "$@")"
+}
+_gosh_reload_hook () {
+[ -n "$COMP_LINE" ] && return  # do nothing if completing
+[ "$BASH_COMMAND" = "$PROMPT_COMMAND" ] && return # don't cause a preexec for $PROMPT_COMMAND
+_gosh_reload
+}
+trap '_gosh_reload_hook' DEBUG
+`
+	if builtin != "" {
+		hook += builtin + ` () { _gosh_reload ` + reloadForceFlag + `; }
+`
+	}
+
+	return hook
+}
+
+func (bashDialect) ErrTrap() string {
+	// The trap is called in the context of the failed command, so that BASH_SOURCE[1] and FUNCNAME[1:] are of the command.
+	// It never fails even when the fd is closed.
+	return `
+set -o errtrace
+_gosh_err_trap () {
+local cmd=${3//[$'\t\n']/ }
+{ printf '` + strings.TrimSuffix(scriptErrorPrefix, "\t") + `\t%d\t%s\t%d\t%s\t%s\n' "$1" "${BASH_SOURCE[1]}" "$2" "$cmd" "${FUNCNAME[*]:1}" >&"$` + diagnosticsFDEnv + `"; } 2>/dev/null
+}
+trap '_gosh_err_trap "$?" "$LINENO" "$BASH_COMMAND"' ERR
+`
+}
+
+func (bashDialect) InteractiveRC(c InteractiveConfig) string {
+	var rc string
+
+	// --rcfile replaces ~/.bashrc, so we source it on behalf of bash
+	if c.UserRC {
+		rc += "[ -f ~/.bashrc ] && . ~/.bashrc\n"
+	}
+
+	rc += "PS1=" + shellQuote(c.Prompt) + "\n"
+
+	if c.HistFile != "" {
+		rc += "HISTFILE=" + shellQuote(c.HistFile) + "\n"
+	}
+
+	return rc
+}
+
+func (bashDialect) Command(envfile string, interactive bool, args []string) ([]string, []string) {
+	if interactive {
+		return append([]string{"--rcfile", envfile}, args...), nil
+	}
+
+	return args, []string{"BASH_ENV=" + envfile}
+}
+
+type shDialect struct{}
+
+func (shDialect) Name() string {
+	return "sh"
+}
+
+func (shDialect) DefaultPath() string {
+	return "/bin/sh"
+}
+
+func (shDialect) Preamble() string {
+	// unset for nested interactive shells
+	return "unset ENV\n"
+}
+
+func (shDialect) Shim(trigger, name string) string {
+	return `#!/bin/sh
+` + dispatchClientEnv + `=` + shellQuote(trigger) + ` exec $SELF_EXECUTABLE $SELF_ARGS ` + shellQuote(trigger) + ` ` + name + ` "$@"
+`
+}
+
+func (shDialect) Function(trigger, name string) string {
+	// Implementations like dash reject the function named like `use-cluster`, which fails the whole env file.
+	// Such a function is called via the shim instead, so that it's unable to modify the calling shell.
+	if !posixName.MatchString(name) {
+		return ""
+	}
+
+	// POSIX sh has no local variables. Use a name that is unlikely to conflict.
+	return `
+` + name + ` () {
+{ _gosh_effects=$(` + shellEffectsFDEnv + `=4 ` + callFunc(trigger, name) + ` 4>&1 1>&5 5>&-; echo "return $?"); } 5>&1
+eval "$_gosh_effects"
+}
+`
+}
+
+func (shDialect) ListFunctions() string {
+	return ""
+}
+
+func (shDialect) ReloadHook(builtin string) string {
+	return ""
+}
+
+func (shDialect) ErrTrap() string {
+	// POSIX sh has no ERR trap
+	return ""
+}
+
+func (shDialect) InteractiveRC(c InteractiveConfig) string {
+	var rc string
+
+	// ENV replaces the user's ~/.shrc if any, so we source it on behalf of sh
+	if c.UserRC {
+		rc += "[ -f ~/.shrc ] && . ~/.shrc\n"
+	}
+
+	rc += "PS1=" + shellQuote(c.Prompt) + "\n"
+
+	// Some implementations like dash don't support reading the history file, but others do.
+	if c.HistFile != "" {
+		rc += "HISTFILE=" + shellQuote(c.HistFile) + "\n"
+	}
+
+	return rc
+}
+
+func (shDialect) Command(envfile string, interactive bool, args []string) ([]string, []string) {
+	if interactive {
+		return append([]string{"-i"}, args...), []string{"ENV=" + envfile}
+	}
+
+	// Unlike bash's BASH_ENV, POSIX sh reads ENV only in interactive sessions.
+	// So we source the envfile ourselves before running the script.
+	source := ". " + shellQuote(envfile) + "\n"
+
+	switch {
+	case len(args) == 0:
+		return []string{"-c", source + ". /dev/stdin"}, nil
+	case args[0] == "-c" && len(args) > 1:
+		return append([]string{"-c", source + args[1]}, args[2:]...), nil
+	default:
+		return append([]string{"-c", source + `. "$0"`}, args...), nil
+	}
+}
+
+// posixName matches the names that POSIX sh accepts as function names
+var posixName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// callFunc returns the command to call the exported function via the dispatcher of the gosh application.
+// The trigger arg is passed via the envvar too, so that the client knows where the function call starts in its args.
+func callFunc(trigger, name string) string {
+	return dispatchClientEnv + `=` + shellQuote(trigger) + ` $SELF_EXECUTABLE $SELF_ARGS ` + shellQuote(trigger) + ` ` + name + ` "$@"`
+}
+
+// shellWord returns s as is when the shell reads it as a single word as-is, or quoted with shellQuote otherwise,
+// so that the command reads naturally in the errors reporting it, like ScriptError.
+// The first word of a command is quoted when it's a reserved word like `time`, which needs to be run as a command.
+func shellWord(s string, first bool) string {
+	if !plainWord.MatchString(s) || (first && reservedWords[s]) {
+		return shellQuote(s)
+	}
+
+	return s
+}
+
+// plainWord matches the words that contain no char special to the shell.
+// `=` is excluded, as the first word with it is an assignment.
+var plainWord = regexp.MustCompile(`^[A-Za-z0-9_@%+:,./-]+$`)
+
+var reservedWords = map[string]bool{
+	"case": true, "coproc": true, "do": true, "done": true, "elif": true, "else": true, "esac": true, "fi": true,
+	"for": true, "function": true, "if": true, "in": true, "select": true, "then": true, "time": true, "until": true, "while": true,
+}
+
+// shellQuote quotes s with single quotes so that any POSIX shell reads it as a single word as-is.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
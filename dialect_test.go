@@ -0,0 +1,111 @@
+package gosh_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/context"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShDialect(t *testing.T) {
+	sh := &gosh.Shell{
+		Dialect:     gosh.Sh,
+		Interpreter: "/bin/dash",
+	}
+
+	sh.Export("hello", func(ctx context.Context, target string) {
+		fmt.Fprintf(context.Stdout(ctx), "hello %s\n", target)
+	})
+
+	sh.Export("use-cluster", func(ctx context.Context, name string) {
+		fmt.Fprintf(context.Stdout(ctx), "using %s\n", name)
+	})
+
+	goshtest.Run(t, sh, func() {
+		t.Run("command", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			err := sh.Run(t, "hello", "world", gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "hello world\n", stdout.String())
+		})
+
+		t.Run("script", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			err := sh.Run(t, "sh", "-c", "for i in 1 2; do hello world; done", gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "hello world\nhello world\n", stdout.String())
+		})
+
+		t.Run("non-POSIX name", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			// Called via the shim, as dash rejects the function name
+			err := sh.Run(t, gosh.Script("use-cluster foo; hello world"), gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "using foo\nhello world\n", stdout.String())
+		})
+
+		t.Run("script file", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			script := filepath.Join(t.TempDir(), "test.sh")
+			err := ioutil.WriteFile(script, []byte("hello \"$1\"\n"), 0644)
+			assert.NoError(t, err)
+
+			err = sh.Run(t, script, "file", gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "hello file\n", stdout.String())
+		})
+	})
+}
+
+func TestInteractiveRC(t *testing.T) {
+	testcases := []struct {
+		dialect gosh.ShellDialect
+		path    string
+		rcfile  string
+	}{
+		{dialect: gosh.Bash, path: "/bin/bash", rcfile: ".bashrc"},
+		{dialect: gosh.Sh, path: "/bin/dash", rcfile: ".shrc"},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+
+		t.Run(tc.dialect.Name(), func(t *testing.T) {
+			home := t.TempDir()
+
+			err := ioutil.WriteFile(filepath.Join(home, tc.rcfile), []byte("PS1='user$ '\nFROM_RC=yes\n"), 0644)
+			assert.NoError(t, err)
+
+			run := func(c gosh.InteractiveConfig) string {
+				t.Helper()
+
+				cmd := exec.Command(tc.path, "-c", tc.dialect.InteractiveRC(c)+`echo "$FROM_RC|$PS1|$HISTFILE"`)
+				cmd.Env = []string{"HOME=" + home}
+
+				out, err := cmd.Output()
+				assert.NoError(t, err)
+
+				return string(out)
+			}
+
+			// The prompt overrides the one in the user's rc file
+			assert.Equal(t, "yes|it's$ |/tmp/hist\n", run(gosh.InteractiveConfig{Prompt: "it's$ ", HistFile: "/tmp/hist", UserRC: true}))
+			assert.Equal(t, "|myapp$ |\n", run(gosh.InteractiveConfig{Prompt: "myapp$ "}))
+		})
+	}
+}
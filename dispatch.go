@@ -0,0 +1,330 @@
+package gosh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// The dispatcher lets the top-level gosh process serve calls to exported functions
+// for the lifetime of a bash session.
+// Each shim in .cmds runs the gosh binary in the "dispatch client" mode, which forwards
+// the argv, env, cwd and stdio fds to the dispatcher over a unix domain socket and
+// exits with the returned status, without running main() at all.
+// When the socket is absent, or the dispatcher rejects the call, the client falls back
+// to running the function in its own process as before.
+
+const (
+	// DispatcherSocketEnv is the name of the envvar that points to the dispatcher socket
+	DispatcherSocketEnv = "GOSH_SOCKET"
+
+	// dispatchClientEnv is set by the shim only to the gosh process it executes.
+	// Its value is the trigger arg that precedes the function call in the args.
+	dispatchClientEnv = "GOSH_DISPATCH"
+
+	// shellEffectsFDEnv is set by the shell function wrapper to tell the fd to write shell effects to
+	shellEffectsFDEnv = "GOSH_EFFECTS_FD"
+)
+
+// shellEffects is where the exported function writes the shell statements to be evaluated
+// by the calling shell function wrapper. It's nil when the process wasn't called by the wrapper.
+var shellEffects *os.File
+
+type dispatchRequest struct {
+	Executable string
+	Args       []string
+	Env        []string
+	Dir        string
+}
+
+type dispatchResponse struct {
+	Status   int
+	Rejected bool
+}
+
+func init() {
+	if v := os.Getenv(shellEffectsFDEnv); v != "" {
+		// The fd is meant only for this process. Don't let children write to it.
+		os.Unsetenv(shellEffectsFDEnv)
+
+		if fd, err := strconv.Atoi(v); err == nil {
+			syscall.CloseOnExec(fd)
+			shellEffects = os.NewFile(uintptr(fd), "shelleffects")
+		}
+	}
+
+	trigger := os.Getenv(dispatchClientEnv)
+	if trigger == "" {
+		return
+	}
+
+	// Unset it so that the fallback path and any children see the original environment
+	os.Unsetenv(dispatchClientEnv)
+
+	if status, ok := dispatch(os.Getenv(DispatcherSocketEnv), trigger, os.Args); ok {
+		os.Exit(status)
+	}
+}
+
+// dispatch forwards the function call denoted by osArgs to the dispatcher listening on the socket.
+// It returns false when the call needs to be handled by the current process instead.
+func dispatch(socket, trigger string, osArgs []string) (int, bool) {
+	if socket == "" {
+		return 0, false
+	}
+
+	var args []string
+	for i, a := range osArgs {
+		if a == trigger {
+			args = osArgs[i+1:]
+			break
+		}
+	}
+
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return 0, false
+	}
+	defer conn.Close()
+
+	ex, err := os.Executable()
+	if err != nil {
+		return 0, false
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return 0, false
+	}
+
+	req := dispatchRequest{
+		Executable: ex,
+		Args:       args,
+		Env:        os.Environ(),
+		Dir:        dir,
+	}
+
+	fds := []int{int(os.Stdin.Fd()), int(os.Stdout.Fd()), int(os.Stderr.Fd())}
+	if shellEffects != nil {
+		fds = append(fds, int(shellEffects.Fd()))
+	}
+
+	rights := syscall.UnixRights(fds...)
+	if _, _, err := conn.WriteMsgUnix([]byte{0}, rights, nil); err != nil {
+		return 0, false
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return 0, false
+	}
+
+	var res dispatchResponse
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		fmt.Fprintf(os.Stderr, "gosh: lost connection to dispatcher: %v\n", err)
+		return 1, true
+	}
+
+	if res.Rejected {
+		return 0, false
+	}
+
+	return res.Status, true
+}
+
+type dispatcher struct {
+	app *App
+
+	dir      string
+	listener *net.UnixListener
+}
+
+// startDispatcher starts serving function calls on a new unix domain socket.
+// The returned dispatcher needs to be closed once the bash session ends.
+func (c *App) startDispatcher(ctx context.Context) (*dispatcher, error) {
+	dir, err := ioutil.TempDir("", "gosh")
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, "sock"), Net: "unix"})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed starting dispatcher: %w", err)
+	}
+
+	d := &dispatcher{
+		app:      c,
+		dir:      dir,
+		listener: l,
+	}
+
+	go d.serve(ctx)
+
+	return d, nil
+}
+
+func (d *dispatcher) Path() string {
+	return d.listener.Addr().String()
+}
+
+// varsFile returns the path to the file persisting the variables of the session,
+// which is removed along with the socket.
+func (d *dispatcher) varsFile() string {
+	return filepath.Join(d.dir, "vars.json")
+}
+
+func (d *dispatcher) Close() error {
+	err := d.listener.Close()
+	os.RemoveAll(d.dir)
+	return err
+}
+
+func (d *dispatcher) serve(ctx context.Context) {
+	for {
+		conn, err := d.listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			if err := d.handle(ctx, conn); err != nil && d.app.Debug {
+				fmt.Fprintf(os.Stderr, "gosh: dispatcher: %v\n", err)
+			}
+		}()
+	}
+}
+
+func (d *dispatcher) handle(ctx context.Context, conn *net.UnixConn) error {
+	// stdin, stdout, stderr, and optionally the shell effects
+	oob := make([]byte, syscall.CmsgSpace(4*4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return fmt.Errorf("reading stdio fds: %w", err)
+	}
+
+	files, err := parseRights(oob[:oobn])
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	if len(files) != 3 && len(files) != 4 {
+		return fmt.Errorf("expected 3 or 4 fds, got %d", len(files))
+	}
+
+	var req dispatchRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return fmt.Errorf("decoding request: %w", err)
+	}
+
+	enc := json.NewEncoder(conn)
+
+	// The client is a different binary, which is the case after the interactive shell hot-reloaded it.
+	// Let it run the function on its own so that the modified code takes effect.
+	if !sameFile(req.Executable, d.app.SelfPath) {
+		return enc.Encode(dispatchResponse{Rejected: true})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The client never writes anything after the request,
+	// so this returns only when the client has gone away, e.g. on Ctrl-C.
+	go func() {
+		conn.Read(make([]byte, 1))
+		cancel()
+	}()
+
+	ctx = context.WithStdin(ctx, files[0])
+	ctx = context.WithStdout(ctx, files[1])
+	ctx = context.WithStderr(ctx, files[2])
+	ctx = context.WithDir(ctx, req.Dir)
+	ctx = context.WithEnviron(ctx, req.Env)
+	if !context.HasScope(ctx) {
+		ctx = context.WithScope(ctx)
+	}
+	if len(files) > 3 {
+		ctx = context.WithShellEffects(ctx, files[3])
+	}
+
+	args := []interface{}{d.app.TriggerArg}
+	for _, a := range req.Args {
+		args = append(args, a)
+	}
+
+	status := d.call(ctx, args, files[2])
+
+	return enc.Encode(dispatchResponse{Status: status})
+}
+
+func (d *dispatcher) call(ctx context.Context, args []interface{}, stderr io.Writer) (status int) {
+	// A panicking function would otherwise take down the whole session,
+	// whereas it only terminated the re-executed process before.
+	// 2 is the exit status of a Go program that panicked.
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(stderr, "panic: %v\n", r)
+			status = 2
+		}
+	}()
+
+	funExists, err := d.app.HandleFuncs(ctx, args, nil)
+	if err != nil && isBrokenPipe(err) {
+		// Exit quietly as if it was killed by SIGPIPE, like other commands in a shell pipeline
+		return 128 + int(syscall.SIGPIPE)
+	}
+	if err != nil {
+		// The failed command has already written its own error to stderr
+		var exitErr *ExitError
+		if !errors.As(err, &exitErr) {
+			fmt.Fprintf(stderr, "%v\n", err)
+		}
+		if !funExists {
+			return 127
+		}
+		return exitCode(err)
+	}
+
+	return 0
+}
+
+func parseRights(oob []byte) ([]*os.File, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("parsing socket control message: %w", err)
+	}
+
+	var files []*os.File
+
+	for _, m := range msgs {
+		fds, err := syscall.ParseUnixRights(&m)
+		if err != nil {
+			return nil, fmt.Errorf("parsing unix rights: %w", err)
+		}
+
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "dispatched"))
+		}
+	}
+
+	return files, nil
+}
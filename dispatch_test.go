@@ -0,0 +1,65 @@
+package gosh_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/context"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcher(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	var calls int32
+
+	pid := os.Getpid()
+
+	sh.Export("hello", func(ctx context.Context, target string) {
+		atomic.AddInt32(&calls, 1)
+
+		fmt.Fprintf(context.Stdout(ctx), "hello %s\n", target)
+
+		if os.Getpid() != pid {
+			fmt.Fprintf(context.Stderr(ctx), "served by a re-executed process\n")
+		}
+	})
+
+	goshtest.Run(t, sh, func() {
+		t.Run("ok", func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+
+			err := sh.Run(t, "bash", "-c", "for i in 1 2 3; do hello world; done", gosh.WriteStdout(&stdout), gosh.WriteStderr(&stderr))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "hello world\nhello world\nhello world\n", stdout.String())
+			assert.Equal(t, "", stderr.String())
+			assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+		})
+
+		t.Run("missing args", func(t *testing.T) {
+			err := sh.Run(t, "bash", "-c", "hello")
+
+			assert.Error(t, err)
+		})
+	})
+}
+
+func TestNestedShellLimit(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	goshtest.Run(t, sh, func() {
+		// Pretends to be run by the 32nd nested shell
+		err := sh.Run(t, gosh.Script("true"), gosh.Env("GOSH_DEPTH=32"))
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "too many nested shells")
+		}
+
+		assert.NoError(t, sh.Run(t, gosh.Script("true"), gosh.Env("GOSH_DEPTH=30")))
+	})
+}
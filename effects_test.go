@@ -0,0 +1,59 @@
+package gosh_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/context"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellEffects(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("use-cluster", func(ctx context.Context, name string) error {
+		if err := context.SetShellEnv(ctx, "KUBECONFIG", "/tmp/"+name+"/kubeconfig"); err != nil {
+			return err
+		}
+
+		if err := context.SetShellVar(ctx, "CLUSTER", name); err != nil {
+			return err
+		}
+
+		return context.Chdir(ctx, "/")
+	})
+
+	goshtest.Run(t, sh, func() {
+		t.Run("ok", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			script := filepath.Join(t.TempDir(), "test.sh")
+			err := ioutil.WriteFile(script, []byte(`use-cluster "it's"; echo "$KUBECONFIG $CLUSTER $(pwd)"`), 0644)
+			assert.NoError(t, err)
+
+			err = sh.Run(t, script, gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "/tmp/it's/kubeconfig it's /\n", stdout.String())
+		})
+
+		t.Run("nested shell", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			err := sh.Run(t, "bash", "-c", `use-cluster bar; echo "$KUBECONFIG $CLUSTER $(pwd)"`, gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "/tmp/bar/kubeconfig bar /\n", stdout.String())
+		})
+
+		t.Run("not called from a shell", func(t *testing.T) {
+			err := sh.Run(t, "use-cluster", "foo")
+
+			assert.EqualError(t, err, "unable to run `export KUBECONFIG='/tmp/foo/kubeconfig'`: not called from a shell")
+		})
+	})
+}
@@ -210,11 +210,18 @@ func New() *gosh.Shell {
 		}()
 
 		if !opts.DryRun {
-			if err := sh.Run(gosh.Cmd(kubeconfigEnv, "export")); err != nil {
+			session, err := sh.Session(ctx)
+			if err != nil {
+				return err
+			}
+			defer session.Close()
+
+			// The commands that follow in the session see the exported KUBECONFIG
+			if err := session.Run("export", "KUBECONFIG="+kubeconfigPath); err != nil {
 				return err
 			}
 
-			if err := sh.Run(ctx, kubeconfigEnv, "kind", "export", "kubeconfig", "--name", name); err != nil {
+			if err := session.Run("kind", "export", "kubeconfig", "--name", name); err != nil {
 				return err
 			}
 
@@ -222,19 +229,17 @@ func New() *gosh.Shell {
 				return fmt.Errorf("failed finding exported kubeconfig: %w", err)
 			}
 
-			var buf bytes.Buffer
+			var currentContext string
 
-			if err := sh.Run(ctx, kubeconfigEnv, "kubectl", "config", "current-context", gosh.WriteStdout(&buf)); err != nil {
+			if err := session.Run("kubectl", "config", "current-context", gosh.OutString(&currentContext)); err != nil {
 				return fmt.Errorf("failed obtaining current kubeconfig context: %w", err)
 			}
 
-			currentContext := buf.String()
-
 			infof(ctx, "current context is %q", currentContext)
 
 			currentContext = "kind-" + name
 
-			if err := sh.Run(ctx, kubeconfigEnv, "kubectl", "get", "node"); err != nil {
+			if err := session.Run("kubectl", "get", "node"); err != nil {
 				return err
 			}
 
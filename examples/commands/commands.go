@@ -20,7 +20,7 @@ func New() *gosh.Shell {
 		for scanner.Scan() {
 			line := scanner.Text()
 			if strings.Contains(line, pattern) {
-				fmt.Fprint(os.Stdout, line+"\n")
+				fmt.Fprint(context.Stdout(ctx), line+"\n")
 			}
 		}
 	})
@@ -44,7 +44,7 @@ func New() *gosh.Shell {
 
 		for scanner.Scan() {
 			line := scanner.Text()
-			fmt.Fprint(os.Stdout, line+"\n")
+			fmt.Fprint(context.Stdout(ctx), line+"\n")
 		}
 
 		return nil
@@ -0,0 +1,134 @@
+package gosh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// maxStderrTail is the max number of bytes of stderr kept in ExitError
+const maxStderrTail = 4096
+
+// ExitError is returned by Run when the command exited with a non-zero status, or was killed by a signal.
+type ExitError struct {
+	// Command is the command that failed, like []string{"kubectl", "apply", "-f", "-"}
+	Command []string
+
+	// Code is the exit status of the command.
+	// It's 128+n when the command was killed by the signal n, as shells do.
+	Code int
+
+	// Signal is the signal that killed the command, or 0 if it exited by itself.
+	Signal syscall.Signal
+
+	// Stderr is the tail of the stderr of the command, up to 4 KiB.
+	// It's empty when the stderr of the command is the terminal, like os.Stderr of an application run from the terminal,
+	// in which case the command writes directly to it, and the user has already seen it.
+	Stderr string
+}
+
+func (e *ExitError) Error() string {
+	var msg string
+
+	if e.Signal != 0 {
+		msg = fmt.Sprintf("`%s` killed by signal: %v", strings.Join(e.Command, " "), e.Signal)
+	} else {
+		msg = fmt.Sprintf("`%s` exited %d", strings.Join(e.Command, " "), e.Code)
+	}
+
+	if line := lastLine(e.Stderr); line != "" {
+		msg += ": " + line
+	}
+
+	return msg
+}
+
+// ExitCode returns the exit status of the command.
+// Any error with this method, including the ones returned by your Go functions, determines the exit status of the
+// shell function and MustExec.
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// exitCoder is implemented by errors that determine the exit status
+type exitCoder interface {
+	ExitCode() int
+}
+
+// exitCode returns the exit status for err, defaulting to 1.
+func exitCode(err error) int {
+	var ec exitCoder
+	if errors.As(err, &ec) && ec.ExitCode() > 0 {
+		return ec.ExitCode()
+	}
+
+	return 1
+}
+
+// newExitError converts the error returned by running the command into ExitError.
+// Other errors are returned as is.
+func newExitError(command []string, err error, stderr *tailWriter) error {
+	if scriptErr, ok := err.(*ScriptError); ok {
+		scriptErr.Err = newExitError(command, scriptErr.Err, stderr)
+		return scriptErr
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+
+	e := &ExitError{Command: command, Code: exitErr.ExitCode()}
+
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		e.Signal = status.Signal()
+		e.Code = 128 + int(e.Signal)
+	}
+
+	if stderr != nil {
+		e.Stderr = stderr.String()
+	}
+
+	return e
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// tailWriter writes to w while keeping the last max bytes written.
+type tailWriter struct {
+	w   io.Writer
+	max int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newTailWriter(w io.Writer, max int) *tailWriter {
+	return &tailWriter{w: w, max: max}
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+	}
+	t.mu.Unlock()
+
+	return t.w.Write(p)
+}
+
+func (t *tailWriter) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return string(t.buf)
+}
@@ -0,0 +1,89 @@
+package gosh_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+type exitCodeError struct {
+	code int
+}
+
+func (e exitCodeError) Error() string {
+	return fmt.Sprintf("failed with %d", e.code)
+}
+
+func (e exitCodeError) ExitCode() int {
+	return e.code
+}
+
+func TestExitError(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("fail", func() error {
+		return exitCodeError{code: 42}
+	})
+
+	goshtest.Run(t, sh, func() {
+		t.Run("command", func(t *testing.T) {
+			var stderr bytes.Buffer
+
+			err := sh.Run(t, "bash", "-c", "echo oops >&2; exit 3", gosh.WriteStderr(&stderr))
+
+			var exitErr *gosh.ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			assert.Equal(t, []string{"bash", "-c", "echo oops >&2; exit 3"}, exitErr.Command)
+			assert.Equal(t, 3, exitErr.ExitCode())
+			assert.Equal(t, "oops\n", exitErr.Stderr)
+			assert.Equal(t, "oops\n", stderr.String())
+			assert.EqualError(t, err, "`bash -c echo oops >&2; exit 3` exited 3: oops")
+		})
+
+		t.Run("file", func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			err = sh.Run(t, "bash", "-c", "echo oops >&2; exit 3", gosh.WriteStderr(f))
+
+			var exitErr *gosh.ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			assert.Equal(t, "oops\n", exitErr.Stderr)
+
+			written, err := ioutil.ReadFile(f.Name())
+			assert.NoError(t, err)
+			assert.Equal(t, "oops\n", string(written))
+		})
+
+		t.Run("function", func(t *testing.T) {
+			var stderr bytes.Buffer
+
+			err := sh.Run(t, "bash", "-c", "fail", gosh.WriteStderr(&stderr))
+
+			var exitErr *gosh.ExitError
+			if !errors.As(err, &exitErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			assert.Equal(t, 42, exitErr.ExitCode())
+			assert.Equal(t, "failed with 42\n", exitErr.Stderr)
+		})
+	})
+}
@@ -0,0 +1,123 @@
+package gosh
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// Context is the context of a Go function called as a shell function.
+// Declare it as the first parameter of an exported function to read and write the stdio of the caller,
+// and to see the environment, working directory and args of the call, like:
+//
+//	sh.Export("hello", func(ctx gosh.Context, target string) {
+//		fmt.Fprintf(ctx.Stdout(), "hello %s\n", target)
+//	})
+//
+// It's a context.Context too, so that it can be passed to anything that takes one, including Run.
+type Context interface {
+	context.Context
+
+	// Stdin returns the stdin of the caller
+	Stdin() io.Reader
+
+	// Stdout returns the stdout of the caller
+	Stdout() io.Writer
+
+	// Stderr returns the stderr of the caller
+	Stderr() io.Writer
+
+	// Getenv returns the value of the environment variable of the caller, or "" if it's not set
+	Getenv(key string) string
+
+	// Environ returns the environment variables of the caller, in the form of "key=value"
+	Environ() []string
+
+	// Dir returns the working directory of the caller
+	Dir() string
+
+	// Args returns the args passed to the function, excluding the function name
+	Args() []string
+
+	// Shell returns the shell that called the function
+	Shell() *Shell
+
+	// Diagf writes a diagnostic log, like Shell.Diagf
+	Diagf(format string, args ...interface{})
+
+	// Run runs the command within the context, like Shell.Run
+	Run(vars ...interface{}) error
+}
+
+type shellKey struct{}
+
+var contextType = reflect.TypeOf((*Context)(nil)).Elem()
+
+type goshContext struct {
+	context.Context
+
+	shell *Shell
+	args  []string
+}
+
+// newContext returns the Context for the function called with funArgs within ctx.
+func newContext(ctx context.Context, funArgs []interface{}) *goshContext {
+	args := make([]string, len(funArgs))
+	for i, a := range funArgs {
+		args[i] = fmt.Sprint(a)
+	}
+
+	shell, _ := ctx.Value(shellKey{}).(*Shell)
+
+	return &goshContext{Context: ctx, shell: shell, args: args}
+}
+
+func (c *goshContext) Stdin() io.Reader {
+	return context.Stdin(c)
+}
+
+func (c *goshContext) Stdout() io.Writer {
+	return context.Stdout(c)
+}
+
+func (c *goshContext) Stderr() io.Writer {
+	return context.Stderr(c)
+}
+
+func (c *goshContext) Getenv(key string) string {
+	return getenv(c.Environ(), key)
+}
+
+func (c *goshContext) Environ() []string {
+	return context.Environ(c)
+}
+
+func (c *goshContext) Dir() string {
+	return context.Dir(c)
+}
+
+func (c *goshContext) Args() []string {
+	return c.args
+}
+
+func (c *goshContext) Shell() *Shell {
+	return c.shell
+}
+
+func (c *goshContext) Diagf(format string, args ...interface{}) {
+	if c.shell == nil {
+		return
+	}
+
+	c.shell.diagf(2, format, args...)
+}
+
+func (c *goshContext) Run(vars ...interface{}) error {
+	if c.shell == nil {
+		return fmt.Errorf("no shell to run %v in", vars)
+	}
+
+	return c.shell.Run(append([]interface{}{c}, vars...)...)
+}
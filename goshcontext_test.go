@@ -0,0 +1,78 @@
+package gosh_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContext(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("greet", func(ctx gosh.Context, target string) error {
+		in, err := ioutil.ReadAll(ctx.Stdin())
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(ctx.Stdout(), "%s %s\n", strings.TrimSpace(string(in)), target)
+		fmt.Fprintf(ctx.Stdout(), "args=%v greeting=%s\n", ctx.Args(), ctx.Getenv("GREETING"))
+		fmt.Fprintf(ctx.Stderr(), "to stderr\n")
+
+		return ctx.Run("echo", "nested")
+	})
+
+	goshtest.Run(t, sh, func() {
+		var stdout, stderr bytes.Buffer
+
+		err := sh.Run(t, "bash", "-c", "echo hello | GREETING=hi greet world", gosh.WriteStdout(&stdout), gosh.WriteStderr(&stderr))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world\nargs=[world] greeting=hi\nnested\n", stdout.String())
+		assert.Equal(t, "to stderr\n", stderr.String())
+	})
+}
+
+func TestContextRunConfig(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := &gosh.Shell{}
+
+	sh.Export("where", func(ctx gosh.Context) error {
+		fmt.Fprintf(ctx.Stdout(), "go: %s %s\n", ctx.Dir(), ctx.Getenv("FOO"))
+
+		return ctx.Run("bash", "-c", `echo "sh: $(pwd) $FOO"`)
+	})
+
+	goshtest.Run(t, sh, func() {
+		var stdout bytes.Buffer
+
+		err := sh.Run(t, "where", gosh.Dir(dir), gosh.Env("FOO=bar"), gosh.WriteStdout(&stdout))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "go: "+dir+" bar\nsh: "+dir+" bar\n", stdout.String())
+
+		stdout.Reset()
+
+		// The function sees the dir and env of the calling shell too
+		err = sh.Run(t, "bash", "-c", "cd sub && FOO=baz where", gosh.Dir(dir), gosh.WriteStdout(&stdout))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "go: "+dir+"/sub baz\nsh: "+dir+"/sub baz\n", stdout.String())
+	})
+}
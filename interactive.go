@@ -0,0 +1,80 @@
+package gosh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// SessionHook is a Go function called when an interactive shell session starts or exits.
+type SessionHook func(ctx context.Context) error
+
+// InteractiveConfig customizes interactive shell sessions.
+type InteractiveConfig struct {
+	// Prompt is the PS1 of the session
+	Prompt string
+
+	// HistFile is the path to the file to read and write the command history
+	HistFile string
+
+	// UserRC sources the user's rc file like ~/.bashrc before anything else
+	UserRC bool
+}
+
+// OnStart registers the hook to be called right before an interactive shell session starts.
+// Any error returned by the hook prevents the session from starting.
+func (t *Shell) OnStart(hook SessionHook) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.onStart = append(t.onStart, hook)
+}
+
+// OnExit registers the hook to be called after an interactive shell session exits.
+func (t *Shell) OnExit(hook SessionHook) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.onExit = append(t.onExit, hook)
+}
+
+// appName is the name of the running gosh application, used for defaults like the prompt.
+func appName() string {
+	return strings.TrimSuffix(filepath.Base(os.Args[0]), ".test")
+}
+
+func (t *Shell) interactiveConfig() InteractiveConfig {
+	name := appName()
+
+	c := InteractiveConfig{
+		Prompt:   t.Prompt,
+		HistFile: t.HistFile,
+		UserRC:   t.UserRC,
+	}
+
+	if c.Prompt == "" {
+		// Expanded by the shell on every prompt, so that the user notices the app failed to rebuild
+		c.Prompt = "${" + BuildStatusVar + ":+($" + BuildStatusVar + ") }" + name + "$ "
+	}
+
+	if c.HistFile == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			c.HistFile = filepath.Join(home, "."+name+"_history")
+		}
+	}
+
+	return c
+}
+
+func (c *App) runSessionHooks(ctx context.Context, kind string, hooks []SessionHook) error {
+	for _, h := range hooks {
+		if err := h(ctx); err != nil {
+			return fmt.Errorf("%s hook: %w", kind, err)
+		}
+	}
+
+	return nil
+}
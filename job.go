@@ -0,0 +1,230 @@
+package gosh
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// Job is a command running in the background, started by Start, like the one started by `&` in shells.
+type Job struct {
+	// ID is the number of the job, starting from 1, like %1 in shells
+	ID int
+
+	// Vars are the vars passed to Start
+	Vars []interface{}
+
+	cancel func()
+	done   chan struct{}
+	err    error
+
+	stdout, stderr captureBuffer
+
+	mu sync.Mutex
+
+	// procs are the external commands run by the job that are still running, in the order they started
+	procs []*process
+}
+
+type jobKey struct{}
+
+// Start runs the command in the background, like Run followed by `&` in shells, and returns the job running it.
+// vars are the same as the ones to Run.
+//
+// The stdout and stderr of the command are captured for Job.Stdout and Job.Stderr,
+// while they're still written to the stdout and stderr of the context, or the ones given by WriteStdout and WriteStderr.
+// Give WriteStdout(ioutil.Discard) to only capture it.
+//
+// Canceling the context terminates the job.
+func (t *Shell) Start(vars ...interface{}) (*Job, error) {
+	var ctx context.Context
+	var testCtx *testing.T
+
+	rest := make([]interface{}, 0, len(vars)+2)
+
+	for _, v := range vars {
+		switch typed := v.(type) {
+		case context.Context:
+			ctx = typed
+			continue
+		case *testing.T:
+			testCtx = typed
+		}
+
+		rest = append(rest, v)
+	}
+
+	if err := t.init(testCtx, nil); err != nil {
+		return nil, err
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+
+		if shellEffects != nil {
+			ctx = context.WithShellEffects(ctx, shellEffects)
+		}
+	}
+
+	j := &Job{
+		Vars: vars,
+		done: make(chan struct{}),
+	}
+
+	ctx, j.cancel = context.WithCancel(ctx)
+	ctx = context.WithValue(ctx, jobKey{}, j)
+
+	rest = append(rest, TeeStdout(&j.stdout), TeeStderr(&j.stderr))
+
+	t.jobsMu.Lock()
+	t.lastJobID++
+	j.ID = t.lastJobID
+	t.jobs = append(t.jobs, j)
+	t.jobsMu.Unlock()
+
+	go func() {
+		err := t.Run(append([]interface{}{ctx}, rest...)...)
+
+		t.jobsMu.Lock()
+		for i, o := range t.jobs {
+			if o == j {
+				t.jobs = append(t.jobs[:i:i], t.jobs[i+1:]...)
+				break
+			}
+		}
+		t.jobsMu.Unlock()
+
+		j.err = err
+		j.cancel()
+		close(j.done)
+	}()
+
+	return j, nil
+}
+
+// Jobs returns the jobs that are still running, in the order they started, like `jobs` in shells.
+func (t *Shell) Jobs() []*Job {
+	t.jobsMu.Lock()
+	defer t.jobsMu.Unlock()
+
+	return append([]*Job(nil), t.jobs...)
+}
+
+// WaitJobs waits for all the jobs running at the time of the call, like `wait` in shells.
+// It returns the error of the first failed job in the order they started, if any.
+func (t *Shell) WaitJobs() error {
+	var firstErr error
+
+	for _, j := range t.Jobs() {
+		if err := j.Wait(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Wait waits for the job to finish, and returns the error of the command, like Run does.
+func (j *Job) Wait() error {
+	<-j.done
+
+	return j.err
+}
+
+// Done returns the channel that is closed once the job finished.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Pid returns the process ID of the external command run by the job, like `$!` in shells.
+// For a pipeline, it's the one started first among the ones still running.
+// It's 0 when the job runs no external command, like when it's calling a Go function, or once it finished.
+func (j *Job) Pid() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.procs) == 0 {
+		return 0
+	}
+
+	return j.procs[0].pid
+}
+
+// Signal sends the signal to the external commands run by the job, along with their children, like `kill %1` in shells.
+//
+// When the job runs no external command, like when it's calling a Go function,
+// SIGINT, SIGTERM and SIGKILL cancel the context of the job instead.
+func (j *Job) Signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal: %v", sig)
+	}
+
+	select {
+	case <-j.done:
+		return fmt.Errorf("job %d has already finished", j.ID)
+	default:
+	}
+
+	j.mu.Lock()
+	procs := append([]*process(nil), j.procs...)
+	j.mu.Unlock()
+
+	if len(procs) == 0 {
+		switch s {
+		case syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL:
+			j.cancel()
+			return nil
+		}
+
+		return fmt.Errorf("unable to send %v to job %d: no external command running", sig, j.ID)
+	}
+
+	for _, p := range procs {
+		// The process may have exited in the meantime
+		if err := p.signal(s); err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stdout returns the stdout written by the job so far.
+func (j *Job) Stdout() string {
+	return string(j.stdout.Bytes())
+}
+
+// Stderr returns the stderr written by the job so far.
+func (j *Job) Stderr() string {
+	return string(j.stderr.Bytes())
+}
+
+// trackProcess adds the process started within ctx to the job running it, if any,
+// and returns the func to remove it after it exited.
+func trackProcess(ctx context.Context, p *process) func() {
+	j, _ := ctx.Value(jobKey{}).(*Job)
+	if j == nil {
+		return func() {}
+	}
+
+	j.mu.Lock()
+	j.procs = append(j.procs, p)
+	j.mu.Unlock()
+
+	return func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		for i, o := range j.procs {
+			if o == p {
+				j.procs = append(j.procs[:i:i], j.procs[i+1:]...)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package gosh_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJob(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("wait-canceled", func(ctx gosh.Context) error {
+		<-ctx.Done()
+
+		return ctx.Err()
+	})
+
+	goshtest.Run(t, sh, func() {
+		echo, err := sh.Start(t, "echo", "hello", gosh.WriteStdout(ioutil.Discard))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.NoError(t, echo.Wait())
+		assert.Equal(t, "hello\n", echo.Stdout())
+		assert.Equal(t, 1, echo.ID)
+
+		select {
+		case <-echo.Done():
+		default:
+			t.Error("expected the job to be done")
+		}
+
+		// kill %2
+		sleep, err := sh.Start(t, "sleep", "60")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, []*gosh.Job{sleep}, sh.Jobs())
+
+		for sleep.Pid() == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		assert.NoError(t, sleep.Signal(syscall.SIGTERM))
+
+		var exitErr *gosh.ExitError
+		if err := sleep.Wait(); assert.True(t, errors.As(err, &exitErr)) {
+			assert.Equal(t, syscall.SIGTERM, exitErr.Signal)
+		}
+
+		assert.Empty(t, sh.Jobs())
+		assert.Equal(t, 0, sleep.Pid())
+		assert.Error(t, sleep.Signal(syscall.SIGTERM))
+
+		// A Go function has no process, and is canceled instead
+		fn, err := sh.Start(t, "wait-canceled")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, 0, fn.Pid())
+		assert.NoError(t, fn.Signal(syscall.SIGINT))
+		assert.Error(t, fn.Wait())
+
+		// wait
+		for i := 0; i < 3; i++ {
+			_, err := sh.Start(t, "sleep", "0.1")
+			assert.NoError(t, err)
+		}
+
+		assert.Len(t, sh.Jobs(), 3)
+		assert.NoError(t, sh.WaitJobs())
+		assert.Empty(t, sh.Jobs())
+
+		_, err = sh.Start(t, "false")
+		assert.NoError(t, err)
+		assert.Error(t, sh.WaitJobs())
+	})
+}
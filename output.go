@@ -0,0 +1,199 @@
+package gosh
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// TeeStdout writes the stdout to the writers too, in addition to the stdout of the context or the one given by WriteStdout.
+func TeeStdout(w ...io.Writer) RunOption {
+	return func(rc *RunConfig) {
+		rc.StdoutTees = append(rc.StdoutTees, w...)
+	}
+}
+
+// TeeStderr writes the stderr to the writers too, in addition to the stderr of the context or the one given by WriteStderr.
+func TeeStderr(w ...io.Writer) RunOption {
+	return func(rc *RunConfig) {
+		rc.StderrTees = append(rc.StderrTees, w...)
+	}
+}
+
+// WriteCombined writes both the stdout and stderr to w, in the order the command wrote them, like `2>&1` does.
+// The order is kept only when neither the stdout nor the stderr has other sinks given by TeeStdout and TeeStderr.
+func WriteCombined(w io.Writer) RunOption {
+	return func(rc *RunConfig) {
+		rc.Combined = w
+	}
+}
+
+// Prefix prefixes each line of the stdout and stderr with the label, like "[build] ",
+// so that you can tell the output of the commands running concurrently from each other.
+func Prefix(label string) RunOption {
+	return func(rc *RunConfig) {
+		rc.Prefix = label
+	}
+}
+
+// Timestamp prefixes each line of the stdout and stderr with the time it's written, formatted with the layout like time.RFC3339.
+// It's followed by the label given by Prefix, if any.
+func Timestamp(layout string) RunOption {
+	return func(rc *RunConfig) {
+		rc.TimestampLayout = layout
+	}
+}
+
+// withOutputs returns the context with the stdout and stderr of cfg, and the func to flush them after the command finished.
+// It also returns the stdout explicitly given by cfg, which is nil when the command writes to the stdout of ctx.
+func withOutputs(ctx context.Context, cfg RunConfig) (context.Context, io.Writer, func()) {
+	stdout, stderr := context.Stdout(ctx), context.Stderr(ctx)
+
+	var explicit bool
+
+	if cfg.Stdout.w != nil {
+		stdout = cfg.Stdout.w
+		explicit = true
+	}
+
+	if cfg.Stderr.w != nil {
+		stderr = cfg.Stderr.w
+	}
+
+	if cfg.Combined != nil {
+		stdout, stderr = cfg.Combined, cfg.Combined
+		explicit = true
+	}
+
+	if cfg.Stderr2Stdout {
+		stderr = stdout
+	}
+
+	if len(cfg.StdoutTees) > 0 {
+		stdout = io.MultiWriter(append([]io.Writer{stdout}, cfg.StdoutTees...)...)
+		explicit = true
+	}
+
+	if len(cfg.StderrTees) > 0 {
+		stderr = io.MultiWriter(append([]io.Writer{stderr}, cfg.StderrTees...)...)
+	}
+
+	flush := func() {}
+
+	if cfg.Prefix != "" || cfg.TimestampLayout != "" {
+		prefix := linePrefix(cfg.Prefix, cfg.TimestampLayout)
+
+		if sameWriter(stdout, stderr) {
+			// A single writer lets the command write both to the same pipe, which keeps the order
+			w := newLineWriter(stdout, prefix)
+			stdout, stderr = w, w
+			flush = w.Flush
+		} else {
+			o, e := newLineWriter(stdout, prefix), newLineWriter(stderr, prefix)
+			stdout, stderr = o, e
+			flush = func() {
+				o.Flush()
+				e.Flush()
+			}
+		}
+	}
+
+	ctx = context.WithStdout(ctx, stdout)
+	ctx = context.WithStderr(ctx, stderr)
+
+	if !explicit {
+		return ctx, nil, flush
+	}
+
+	return ctx, stdout, flush
+}
+
+func linePrefix(label, layout string) func() string {
+	if layout == "" {
+		return func() string { return label }
+	}
+
+	return func() string {
+		return time.Now().Format(layout) + " " + label
+	}
+}
+
+// sameWriter returns true when a and b are the same writer, like the one given by WriteCombined.
+func sameWriter(a, b io.Writer) bool {
+	if a == nil || b == nil || reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+
+	return a == b
+}
+
+// lineWriter writes the prefix followed by each line written to it.
+// It's safe for concurrent use, and each line is written to w in a single Write,
+// so that the lines written concurrently are never mixed up.
+type lineWriter struct {
+	w      io.Writer
+	prefix func() string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newLineWriter(w io.Writer, prefix func() string) *lineWriter {
+	return &lineWriter{w: w, prefix: prefix}
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = append(l.buf, p...)
+
+	var n int
+
+	for {
+		i := bytes.IndexByte(l.buf[n:], '\n')
+		if i < 0 {
+			break
+		}
+
+		if err := l.writeLine(l.buf[n : n+i+1]); err != nil {
+			l.buf = l.buf[:0]
+			return 0, err
+		}
+
+		n += i + 1
+	}
+
+	l.buf = append(l.buf[:0], l.buf[n:]...)
+
+	return len(p), nil
+}
+
+// Flush writes the last line that isn't terminated by a newline, followed by a newline.
+func (l *lineWriter) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buf) == 0 {
+		return
+	}
+
+	l.writeLine(append(l.buf, '\n'))
+
+	l.buf = l.buf[:0]
+}
+
+func (l *lineWriter) writeLine(line []byte) error {
+	var out []byte
+
+	out = append(out, l.prefix()...)
+	out = append(out, line...)
+
+	_, err := l.w.Write(out)
+
+	return err
+}
@@ -0,0 +1,111 @@
+package gosh_test
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/context"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a buffer shared by the commands running concurrently
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestOutput(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("report", func(ctx gosh.Context) {
+		fmt.Fprintln(ctx.Stdout(), "go out")
+		fmt.Fprintln(ctx.Stderr(), "go err")
+		fmt.Fprint(ctx.Stdout(), "go partial")
+	})
+
+	goshtest.Run(t, sh, func() {
+		script := gosh.Script(`for i in 1 2 3; do echo "out $i"; echo "err $i" >&2; done; printf partial`)
+
+		var combined bytes.Buffer
+
+		err := sh.Run(t, script, gosh.WriteCombined(&combined), gosh.Prefix("[build] "))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "[build] out 1\n[build] err 1\n[build] out 2\n[build] err 2\n[build] out 3\n[build] err 3\n[build] partial\n", combined.String())
+
+		combined.Reset()
+
+		err = sh.Run(t, "report", gosh.WriteCombined(&combined))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "go out\ngo err\ngo partial", combined.String())
+
+		var stdout, tee1, tee2, stderr bytes.Buffer
+
+		err = sh.Run(t, "bash", "-c", "report", gosh.WriteStdout(&stdout), gosh.WriteStderr(&stderr), gosh.TeeStdout(&tee1, &tee2), gosh.Prefix("> "))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "> go out\n> go partial\n", stdout.String())
+		assert.Equal(t, stdout.String(), tee1.String())
+		assert.Equal(t, stdout.String(), tee2.String())
+		assert.Equal(t, "> go err\n", stderr.String())
+
+		stdout.Reset()
+
+		err = sh.Run(t, "echo", "hello", gosh.WriteStdout(&stdout), gosh.Timestamp("15:04:05"), gosh.Prefix("[echo] "))
+
+		assert.NoError(t, err)
+		assert.Regexp(t, regexp.MustCompile(`^\d\d:\d\d:\d\d \[echo\] hello\n$`), stdout.String())
+	})
+}
+
+func TestOutputConcurrency(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	goshtest.Run(t, sh, func() {
+		var out syncBuffer
+
+		ctx := context.Background()
+
+		var errs []<-chan error
+
+		for _, name := range []string{"a", "b", "c"} {
+			script := gosh.Script(`for i in $(seq 1 50); do echo "line $i of $1"; done`)
+
+			errs = append(errs, sh.GoRun(ctx, t, script, name, gosh.WriteStdout(&out), gosh.Prefix("["+name+"] ")))
+		}
+
+		for _, err := range errs {
+			assert.NoError(t, <-err)
+		}
+
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+
+		assert.Len(t, lines, 150)
+
+		for _, l := range lines {
+			assert.Regexp(t, regexp.MustCompile(`^\[(a|b|c)\] line \d+ of (a|b|c)$`), l)
+			assert.Equal(t, l[1:2], l[len(l)-1:], "the line is prefixed by the label of another command: %s", l)
+		}
+	})
+}
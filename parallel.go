@@ -0,0 +1,223 @@
+package gosh
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// ParallelError is returned by Parallel when any of the commands failed.
+type ParallelError struct {
+	// Commands are the failed commands, in the order they were given
+	Commands []CommandError
+}
+
+// CommandError is the failure of a command run by Parallel.
+type CommandError struct {
+	// Index is the position of the command in the args to Parallel, starting from 0
+	Index int
+
+	// Label is the label prefixed to each line of the output of the command, like "go build ./cmd/app"
+	Label string
+
+	// Command is the Vars of the Command
+	Command []interface{}
+
+	// Err is the error of the command, which is usually ExitError
+	Err error
+}
+
+func (e CommandError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Label, e.Err)
+}
+
+// ExitCode returns the exit status of the command.
+func (e CommandError) ExitCode() int {
+	return exitCode(e.Err)
+}
+
+func (e *ParallelError) Error() string {
+	msgs := make([]string, len(e.Commands))
+	for i, c := range e.Commands {
+		msgs[i] = c.Error()
+	}
+
+	return fmt.Sprintf("%d parallel command(s) failed: %s", len(e.Commands), strings.Join(msgs, "; "))
+}
+
+// ExitCode returns the exit status of the first failed command.
+func (e *ParallelError) ExitCode() int {
+	return e.Commands[0].ExitCode()
+}
+
+// Unwrap returns the errors of the failed commands.
+func (e *ParallelError) Unwrap() []error {
+	errs := make([]error, len(e.Commands))
+	for i, c := range e.Commands {
+		errs[i] = c.Err
+	}
+
+	return errs
+}
+
+// Parallel runs the commands concurrently, up to limit at a time, or all at once when limit is 0, like:
+//
+//	sh.Parallel(ctx, 4, gosh.Cmd("go", "build", "./cmd/a"), gosh.Cmd("go", "build", "./cmd/b"), gosh.Cmd("lint"))
+//
+// A command can be either an exported Go function or an external command.
+// The commands start in the order they're given.
+//
+// Each line of the output of a command is prefixed with its label, like "[go build ./cmd/a] ",
+// so that you can tell them from each other. Give Prefix to the Command to change it.
+//
+// Once a command failed, the rest of the commands are canceled and never started, like `make` does.
+// It returns *ParallelError listing the failed commands, excluding the ones failed due to the cancellation.
+// See ParallelKeepGoing to run all of them regardless of the failures.
+func (t *Shell) Parallel(ctx context.Context, limit int, cmds ...Command) error {
+	return t.parallel(ctx, limit, false, cmds)
+}
+
+// ParallelKeepGoing is like Parallel, but runs all the commands even when some of them failed, like `make -k` does.
+// It returns *ParallelError listing all the failed commands.
+func (t *Shell) ParallelKeepGoing(ctx context.Context, limit int, cmds ...Command) error {
+	return t.parallel(ctx, limit, true, cmds)
+}
+
+func (t *Shell) parallel(ctx context.Context, limit int, keepGoing bool, cmds []Command) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if limit <= 0 || limit > len(cmds) {
+		limit = len(cmds)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sem := make(chan struct{}, limit)
+
+	errs := make([]error, len(cmds))
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed bool
+	)
+
+	for i := range cmds {
+		i := i
+
+		select {
+		case sem <- struct{}{}:
+		case <-runCtx.Done():
+		}
+
+		if runCtx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := t.runLabeled(runCtx, commandLabel(i, cmds[i]), cmds[i])
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err == nil {
+				return
+			}
+
+			// The failures of the commands terminated due to the cancellation are consequences of the first failure.
+			// The ones that failed on their own at the same time are still reported.
+			if failed && !keepGoing && isCanceled(err) {
+				return
+			}
+
+			errs[i] = err
+
+			if !keepGoing && !failed {
+				failed = true
+				cancel()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	var failures []CommandError
+
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		failures = append(failures, CommandError{Index: i, Label: commandLabel(i, cmds[i]), Command: cmds[i].Vars, Err: err})
+	}
+
+	if len(failures) > 0 {
+		return &ParallelError{Commands: failures}
+	}
+
+	// Canceled before all the commands started
+	return ctx.Err()
+}
+
+// isCanceled returns true when err is due to the cancellation of the context,
+// like the one of an exported Go function returning ctx.Err(), or the one of an external command terminated on it.
+func isCanceled(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return true
+	}
+
+	var exitErr *ExitError
+
+	return errors.As(err, &exitErr) && (exitErr.Signal == syscall.SIGTERM || exitErr.Signal == syscall.SIGKILL)
+}
+
+// runLabeled runs the command with each line of its output prefixed with the label.
+// The Prefix given to the command takes precedence, as it's applied after the label.
+func (t *Shell) runLabeled(ctx context.Context, label string, c Command) error {
+	prefix := Prefix("[" + label + "] ")
+
+	if c.stage != nil {
+		return t.Run(ctx, prefix, c)
+	}
+
+	return t.Run(append([]interface{}{ctx, prefix}, c.Vars...)...)
+}
+
+// commandLabel returns the command line of the command at i, like "go build ./cmd/a".
+func commandLabel(i int, c Command) string {
+	var words []string
+
+	for _, v := range c.Vars {
+		switch typed := v.(type) {
+		case string:
+			words = append(words, typed)
+		case []string:
+			words = append(words, typed...)
+		case Script:
+			words = append(words, string(typed))
+		case RunOption:
+		default:
+			if v != nil && reflect.TypeOf(v).Kind() == reflect.Func {
+				words = append(words, FuncOrMethodToCmdName(v))
+			}
+		}
+	}
+
+	if len(words) == 0 {
+		return fmt.Sprintf("%d", i)
+	}
+
+	return strings.Join(words, " ")
+}
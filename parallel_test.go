@@ -0,0 +1,117 @@
+package gosh_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallel(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	var running, maxRunning int32
+
+	sh.Export("work", func(ctx gosh.Context, name string) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+
+		fmt.Fprintf(ctx.Stdout(), "done %s\n", name)
+	})
+
+	sh.Export("fail", func(ctx gosh.Context) error {
+		return fmt.Errorf("boom")
+	})
+
+	var together sync.WaitGroup
+	together.Add(2)
+
+	sh.Export("fail-together", func(ctx gosh.Context, name string) error {
+		together.Done()
+		together.Wait()
+
+		return fmt.Errorf("boom %s", name)
+	})
+
+	goshtest.Run(t, sh, func() {
+		var stdout syncBuffer
+
+		ctx := context.Background()
+
+		// Any of the commands can be the first one to initialize the shell, which needs t
+		err := sh.Parallel(ctx, 2,
+			gosh.Cmd(t, "work", "a", gosh.WriteStdout(&stdout)),
+			gosh.Cmd(t, "work", "b", gosh.WriteStdout(&stdout)),
+			gosh.Cmd(t, "work", "c", gosh.WriteStdout(&stdout)),
+			gosh.Cmd(t, "echo", "d", gosh.WriteStdout(&stdout), gosh.Prefix("d: ")),
+		)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, atomic.LoadInt32(&maxRunning), int32(2))
+
+		lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+		sort.Strings(lines)
+		assert.Equal(t, []string{"[work a] done a", "[work b] done b", "[work c] done c", "d: d"}, lines)
+
+		// The rest are canceled once a command failed
+		err = sh.Parallel(ctx, 1, gosh.Cmd("fail"), gosh.Cmd("sh", "-c", "echo never"))
+
+		var parallelErr *gosh.ParallelError
+		if assert.True(t, errors.As(err, &parallelErr)) {
+			if assert.Len(t, parallelErr.Commands, 1) {
+				assert.Equal(t, 0, parallelErr.Commands[0].Index)
+				assert.Equal(t, "fail", parallelErr.Commands[0].Label)
+				assert.EqualError(t, parallelErr.Commands[0].Err, "boom")
+			}
+		}
+
+		err = sh.Parallel(ctx, 0, gosh.Cmd("sleep", "60"), gosh.Cmd("fail"))
+		if assert.True(t, errors.As(err, &parallelErr)) {
+			if assert.Len(t, parallelErr.Commands, 1) {
+				assert.Equal(t, 1, parallelErr.Commands[0].Index)
+			}
+		}
+
+		// The commands failed on their own at the same time are all reported
+		err = sh.Parallel(ctx, 0, gosh.Cmd("fail-together", "a"), gosh.Cmd("fail-together", "b"))
+		if assert.True(t, errors.As(err, &parallelErr)) {
+			assert.Len(t, parallelErr.Commands, 2)
+		}
+
+		// Each script gets its own env file
+		var scripts []gosh.Command
+		for i := 0; i < 8; i++ {
+			scripts = append(scripts, gosh.Cmd(gosh.Script("sleep 0.5")))
+		}
+		assert.NoError(t, sh.Parallel(ctx, 0, scripts...))
+
+		// or run regardless of the failures
+		var eStdout syncBuffer
+
+		err = sh.ParallelKeepGoing(ctx, 1,
+			gosh.Cmd("fail"),
+			gosh.Cmd("work", "e", gosh.WriteStdout(&eStdout)),
+			gosh.Cmd("sh", "-c", "exit 3"),
+		)
+		if assert.True(t, errors.As(err, &parallelErr)) {
+			assert.Len(t, parallelErr.Commands, 2)
+			assert.Equal(t, 1, parallelErr.ExitCode())
+			assert.Equal(t, "2 parallel command(s) failed: fail: boom; sh -c exit 3: `sh -c exit 3` exited 3", err.Error())
+		}
+		assert.Equal(t, "[work e] done e\n", eStdout.String())
+	})
+}
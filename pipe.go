@@ -2,27 +2,39 @@ package gosh
 
 import (
 	"io"
-	"log"
 
 	"github.com/mumoshu/gosh/context"
 )
 
 func (sh *Shell) Pipe(ctx context.Context, vars ...interface{}) (context.Context, <-chan error) {
-	a, b, close := sh.PipeFromContext(ctx)
+	a, b, close := sh.PipeFromContextWithError(ctx)
 
-	err := make(chan error)
+	// Buffered so that the goroutine never leaks when nobody reads it
+	err := make(chan error, 1)
 
 	go func() {
 		vars = append([]interface{}{a}, vars...)
 		e := sh.Run(vars...)
-		close()
+		close(e)
 		err <- e
 	}()
 
 	return b, err
 }
 
+// PipeFromContext returns the context a whose stdout is connected to the stdin of the context b.
+// Call the returned func once the command writing to a finished, so that the command reading from b sees EOF.
 func (sh *Shell) PipeFromContext(ctx context.Context) (context.Context, context.Context, func()) {
+	a, b, close := sh.PipeFromContextWithError(ctx)
+
+	return a, b, func() {
+		close(nil)
+	}
+}
+
+// PipeFromContextWithError is like PipeFromContext, but the returned func takes the error of the command writing to a, if any.
+// The command reading from b then sees the error instead of EOF, as an *UpstreamError.
+func (sh *Shell) PipeFromContextWithError(ctx context.Context) (context.Context, context.Context, func(error)) {
 	a, b := ctx, ctx
 
 	r, w := io.Pipe()
@@ -35,9 +47,18 @@ func (sh *Shell) PipeFromContext(ctx context.Context) (context.Context, context.
 	b = context.WithStdout(b, context.Stdout(ctx))
 	b = context.WithStderr(b, context.Stderr(ctx))
 
-	return a, b, func() {
-		if err := w.Close(); err != nil {
-			log.Fatal(err)
-		}
+	return a, b, func(err error) {
+		closePipe(w, err)
 	}
 }
+
+// closePipe closes w so that the reader sees EOF, or the upstream error when err isn't nil.
+func closePipe(w *io.PipeWriter, err error) {
+	if err != nil {
+		// Never fails
+		w.CloseWithError(&UpstreamError{Err: err})
+		return
+	}
+
+	w.Close()
+}
@@ -0,0 +1,185 @@
+package gosh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// Pipefail makes a pipeline fail when any of the commands failed, which is the default.
+// Pipefail(false) makes it fail only when the last command failed, as shells do without `set -o pipefail`.
+func Pipefail(enabled bool) RunOption {
+	return func(rc *RunConfig) {
+		rc.NoPipefail = !enabled
+	}
+}
+
+// PipelineError is returned by Run when the commands in a pipeline failed.
+type PipelineError struct {
+	// Stages are the failed commands, in the order they appear in the pipeline
+	Stages []StageError
+}
+
+// StageError is the failure of a command in a pipeline.
+type StageError struct {
+	// Index is the position of the command in the pipeline, starting from 0
+	Index int
+
+	// Command is the Vars of the Command
+	Command []interface{}
+
+	// Err is the error of the command, which is usually ExitError
+	Err error
+}
+
+func (e StageError) Error() string {
+	return fmt.Sprintf("stage %d: %v", e.Index, e.Err)
+}
+
+// ExitCode returns the exit status of the command.
+func (e StageError) ExitCode() int {
+	return exitCode(e.Err)
+}
+
+func (e *PipelineError) Error() string {
+	msgs := make([]string, len(e.Stages))
+	for i, s := range e.Stages {
+		msgs[i] = s.Error()
+	}
+
+	return "pipeline failed: " + strings.Join(msgs, "; ")
+}
+
+// ExitCode returns the exit status of the last failed command, as `set -o pipefail` does.
+func (e *PipelineError) ExitCode() int {
+	return e.Stages[len(e.Stages)-1].ExitCode()
+}
+
+// Unwrap returns the errors of the failed commands.
+func (e *PipelineError) Unwrap() []error {
+	errs := make([]error, len(e.Stages))
+	for i, s := range e.Stages {
+		errs[i] = s.Err
+	}
+
+	return errs
+}
+
+// UpstreamError is read from the stdin of a command in a pipeline,
+// when the command writing to it failed.
+type UpstreamError struct {
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream failed: %v", e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// runPipeline runs the commands concurrently, with the stdout of each command connected to the stdin of the next one.
+//
+// When a command exits, the command writing to it gets io.ErrClosedPipe on write, or SIGPIPE if it's an external command,
+// so that it stops early as it does in shells, which isn't considered a failure.
+func (t *Shell) runPipeline(ctx context.Context, cmds []Command, pipefail bool) error {
+	errs := make([]error, len(cmds))
+
+	var wg sync.WaitGroup
+
+	stdin := context.Stdin(ctx)
+
+	for i := range cmds {
+		i := i
+
+		stageCtx := context.WithStdin(ctx, stdin)
+
+		// The stdin of this stage, which is closed once this stage exits
+		upstream, _ := stdin.(*io.PipeReader)
+
+		var w *io.PipeWriter
+		if i < len(cmds)-1 {
+			var r *io.PipeReader
+			r, w = io.Pipe()
+			stageCtx = context.WithStdout(stageCtx, w)
+			stdin = r
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var err error
+			if cmds[i].stage != nil {
+				err = t.runStage(stageCtx, cmds[i])
+			} else {
+				err = t.Run(append([]interface{}{stageCtx}, cmds[i].Vars...)...)
+			}
+
+			if w != nil {
+				closePipe(w, err)
+			}
+
+			if upstream != nil && i > 0 {
+				upstream.CloseWithError(io.ErrClosedPipe)
+			}
+
+			errs[i] = err
+		}()
+	}
+
+	wg.Wait()
+
+	var failed []StageError
+
+	for i, err := range errs {
+		if !pipefail && i < len(cmds)-1 {
+			continue
+		}
+
+		if err == nil || isUpstreamError(err) {
+			continue
+		}
+
+		// The last command writes to the stdout of the pipeline, which isn't closed by any command in it
+		if isBrokenPipe(err) && i < len(cmds)-1 {
+			continue
+		}
+
+		failed = append(failed, StageError{Index: i, Command: cmds[i].Vars, Err: err})
+	}
+
+	if len(failed) > 0 {
+		return &PipelineError{Stages: failed}
+	}
+
+	return nil
+}
+
+// isUpstreamError returns true when the command failed only because the upstream command failed.
+func isUpstreamError(err error) bool {
+	var upstreamErr *UpstreamError
+
+	return errors.As(err, &upstreamErr)
+}
+
+// isBrokenPipe returns true when the command was terminated because the downstream command exited.
+func isBrokenPipe(err error) bool {
+	if errors.Is(err, io.ErrClosedPipe) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		// A shell exits with 128+n when the command is killed by the signal n
+		return exitErr.Signal == syscall.SIGPIPE || exitErr.Code == 128+int(syscall.SIGPIPE)
+	}
+
+	return false
+}
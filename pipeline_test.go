@@ -0,0 +1,228 @@
+package gosh_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/context"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeline(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("yes", func(ctx gosh.Context) error {
+		for {
+			if _, err := fmt.Fprintln(ctx.Stdout(), "y"); err != nil {
+				return err
+			}
+		}
+	})
+
+	sh.Export("fail", func(ctx gosh.Context) error {
+		fmt.Fprintln(ctx.Stdout(), "partial")
+
+		return fmt.Errorf("boom")
+	})
+
+	var upstreamErr error
+
+	sh.Export("slurp", func(ctx gosh.Context) error {
+		_, err := ioutil.ReadAll(ctx.Stdin())
+
+		upstreamErr = err
+
+		return err
+	})
+
+	goshtest.Run(t, sh, func() {
+		var pipelineErr *gosh.PipelineError
+
+		err := sh.Run(t, gosh.Cmd("false"), gosh.Cmd("cat"))
+		if assert.True(t, errors.As(err, &pipelineErr)) {
+			if assert.Len(t, pipelineErr.Stages, 1) {
+				assert.Equal(t, 0, pipelineErr.Stages[0].Index)
+			}
+			assert.Equal(t, 1, pipelineErr.ExitCode())
+		}
+
+		assert.NoError(t, sh.Run(t, gosh.Cmd("false"), gosh.Cmd("cat"), gosh.Pipefail(false)))
+
+		err = sh.Run(t, gosh.Cmd("sh", "-c", "exit 3"), gosh.Cmd("sh", "-c", "cat; exit 2"))
+		if assert.True(t, errors.As(err, &pipelineErr)) {
+			assert.Len(t, pipelineErr.Stages, 2)
+			assert.Equal(t, 2, pipelineErr.ExitCode())
+			assert.Equal(t, "pipeline failed: stage 0: `sh -c exit 3` exited 3; stage 1: `sh -c cat; exit 2` exited 2", err.Error())
+		}
+
+		// The downstream sees the upstream error instead of EOF
+		err = sh.Run(t, gosh.Cmd("fail"), gosh.Cmd("slurp"))
+		if assert.True(t, errors.As(err, &pipelineErr)) {
+			if assert.Len(t, pipelineErr.Stages, 1) {
+				assert.EqualError(t, pipelineErr.Stages[0].Err, "boom")
+			}
+		}
+
+		var upstream *gosh.UpstreamError
+		if assert.True(t, errors.As(upstreamErr, &upstream)) {
+			assert.EqualError(t, upstream.Err, "boom")
+		}
+
+		// The last command killed by SIGPIPE isn't stopped by the pipeline, but fails
+		err = sh.Run(t, gosh.Cmd("true"), gosh.Cmd("sh", "-c", "kill -PIPE $$"))
+		if assert.True(t, errors.As(err, &pipelineErr)) {
+			if assert.Len(t, pipelineErr.Stages, 1) {
+				assert.Equal(t, 1, pipelineErr.Stages[0].Index)
+			}
+		}
+
+		// The upstream commands stop once the downstream exited
+		for _, yes := range []string{"yes", "bash"} {
+			var stdout bytes.Buffer
+
+			args := []interface{}{yes}
+			if yes == "bash" {
+				args = append(args, "-c", "yes")
+			}
+
+			err = sh.Run(t, gosh.Cmd(args...), gosh.Cmd("head", "-n", "2"), gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "y\ny\n", stdout.String())
+		}
+	})
+}
+
+func TestPipelineRedirections(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	goshtest.Run(t, sh, func() {
+		dir := t.TempDir()
+
+		in := filepath.Join(dir, "in.txt")
+		out := filepath.Join(dir, "out.log")
+
+		if err := ioutil.WriteFile(in, []byte("foo\nbar\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		both := gosh.Cmd("sh", "-c", "echo out; echo err >&2")
+
+		// sh -c '...' 2>&1 | sort > out.log
+		err := sh.Run(t, both.Stderr2Stdout(), gosh.Cmd("sort").StdoutToFile(out, false))
+		assert.NoError(t, err)
+
+		// sh -c '...' 2>&1 | sort >> out.log
+		err = sh.Run(t, both.Stderr2Stdout(), gosh.Cmd("sort").StdoutToFile(out, true))
+		assert.NoError(t, err)
+
+		written, err := ioutil.ReadFile(out)
+		assert.NoError(t, err)
+		assert.Equal(t, "err\nout\nerr\nout\n", string(written))
+
+		// The modifiers leave the original command as is
+		assert.Len(t, both.Vars, 3)
+
+		var stdout, stderr bytes.Buffer
+
+		// cat < in.txt | tr a-z A-Z
+		err = sh.Run(t, gosh.Cmd("cat").StdinFromFile(in), gosh.Cmd("tr", "a-z", "A-Z"), gosh.WriteStdout(&stdout))
+		assert.NoError(t, err)
+		assert.Equal(t, "FOO\nBAR\n", stdout.String())
+
+		stdout.Reset()
+
+		// sh -c '...' 2>/dev/null | cat
+		err = sh.Run(t, both.DiscardStderr(), gosh.Cmd("cat"), gosh.WriteStdout(&stdout), gosh.WriteStderr(&stderr))
+		assert.NoError(t, err)
+		assert.Equal(t, "out\n", stdout.String())
+		assert.Equal(t, "", stderr.String())
+	})
+}
+
+func TestPipelineStages(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	goshtest.Run(t, sh, func() {
+		var stdout bytes.Buffer
+
+		isEven := func(l string) bool {
+			n, err := strconv.Atoi(l)
+			return err == nil && n%2 == 0
+		}
+
+		err := sh.Run(t, gosh.Cmd("seq", "10"), gosh.Filter(isEven), gosh.Map(func(l string) string {
+			return "n=" + l
+		}), gosh.Cmd("tail", "-n", "2"), gosh.WriteStdout(&stdout))
+		assert.NoError(t, err)
+		assert.Equal(t, "n=8\nn=10\n", stdout.String())
+
+		var lines []string
+
+		err = sh.Run(t, gosh.Cmd("printf", "a\\nb\\nc"), gosh.Each(func(l string) error {
+			lines = append(lines, l)
+			return nil
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "b", "c"}, lines)
+
+		// The upstream command stops once the stage stopped reading
+		err = sh.Run(t, gosh.Cmd("yes"), gosh.Each(func(l string) error {
+			return fmt.Errorf("unexpected line %q", l)
+		}))
+
+		var pipelineErr *gosh.PipelineError
+		if assert.True(t, errors.As(err, &pipelineErr)) {
+			if assert.Len(t, pipelineErr.Stages, 1) {
+				assert.Equal(t, 1, pipelineErr.Stages[0].Index)
+				assert.EqualError(t, pipelineErr.Stages[0].Err, `unexpected line "y"`)
+			}
+		}
+
+		// The stage stops once the downstream exited
+		stdout.Reset()
+
+		err = sh.Run(t, gosh.Cmd("yes"), gosh.Map(strings.ToUpper), gosh.Cmd("head", "-n", "2"), gosh.WriteStdout(&stdout))
+		assert.NoError(t, err)
+		assert.Equal(t, "Y\nY\n", stdout.String())
+	})
+}
+
+func TestPipeFromContext(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	t.Run("eof", func(t *testing.T) {
+		a, b, close := sh.PipeFromContext(context.Background())
+
+		go func() {
+			fmt.Fprint(context.Stdout(a), "hello")
+			close()
+		}()
+
+		out, err := ioutil.ReadAll(context.Stdin(b))
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(out))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		a, b, close := sh.PipeFromContextWithError(context.Background())
+
+		go func() {
+			fmt.Fprint(context.Stdout(a), "hello")
+			close(errors.New("failed"))
+		}()
+
+		_, err := ioutil.ReadAll(context.Stdin(b))
+
+		var upstream *gosh.UpstreamError
+		assert.True(t, errors.As(err, &upstream))
+	})
+}
@@ -0,0 +1,318 @@
+package gosh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/mumoshu/gosh/context"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// DefaultKillAfter is how long gosh waits for the processes to exit after sending SIGTERM on cancellation,
+// before killing them with SIGKILL.
+const DefaultKillAfter = 10 * time.Second
+
+// timeoutExitCode is the exit status of the command that timed out, as `timeout` in coreutils uses
+const timeoutExitCode = 124
+
+// forwardedSignals are the signals sent to gosh that are relayed to the processes it runs.
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGQUIT,
+	syscall.SIGTERM,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+	syscall.SIGWINCH,
+}
+
+// Timeout terminates the command when it didn't finish within d, like `timeout` does.
+// Run then returns *TimeoutError.
+//
+// Exported Go functions see the cancellation of their context, and need to return on it.
+func Timeout(d time.Duration) RunOption {
+	return func(rc *RunConfig) {
+		rc.Timeout = d
+	}
+}
+
+// KillAfter is how long gosh waits for the processes to exit after sending SIGTERM on cancellation or Timeout,
+// before killing them with SIGKILL. It defaults to DefaultKillAfter.
+func KillAfter(d time.Duration) RunOption {
+	return func(rc *RunConfig) {
+		rc.KillAfter = d
+	}
+}
+
+// TimeoutError is returned by Run when the command didn't finish within the Timeout.
+type TimeoutError struct {
+	// Timeout is the one given by Timeout
+	Timeout time.Duration
+
+	// Err is the error of the terminated command, which is usually ExitError
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %v: %v", e.Timeout, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, context.DeadlineExceeded) true, as the deadline of the command exceeded.
+func (e *TimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// ExitCode returns 124, as `timeout` does.
+func (e *TimeoutError) ExitCode() int {
+	return timeoutExitCode
+}
+
+type killAfterKey struct{}
+
+// killAfter returns the KillAfter given to the command run within ctx, or DefaultKillAfter.
+func killAfter(ctx context.Context) time.Duration {
+	if d, ok := ctx.Value(killAfterKey{}).(time.Duration); ok {
+		return d
+	}
+
+	return DefaultKillAfter
+}
+
+// runWithTimeout calls f with the context canceled after d, if d isn't 0.
+// The error returned by f is wrapped into TimeoutError when f failed due to the timeout.
+func runWithTimeout(ctx context.Context, d time.Duration, f func(ctx context.Context) error) error {
+	if d <= 0 {
+		return f(ctx)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	err := f(timeoutCtx)
+	if err != nil && timeoutCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return &TimeoutError{Timeout: d, Err: err}
+	}
+
+	return err
+}
+
+// process is a started command, which is either the leader of its own process group,
+// or a member of the process group of gosh.
+type process struct {
+	pid   int
+	group bool
+
+	cmd     *exec.Cmd
+	signals chan os.Signal
+
+	// tty is the fd of the terminal that the process group is put in the foreground of, or -1
+	tty int
+
+	untrack func()
+}
+
+// terminalMu serializes handing over the foreground process group of the terminal to the commands and taking it back.
+var terminalMu sync.Mutex
+
+// runProcess runs cmd until it exits, relaying the signals sent to gosh to it.
+//
+// cmd is started in its own process group unless it's the interactive shell,
+// so that the signals and the cancellation of ctx reach its children and grandchildren too.
+// When the stdin of cmd is the terminal on which gosh is in the foreground, the process group of cmd is put in the foreground
+// while it's running, so that it's able to read from the terminal, and the terminal delivers signals like Ctrl-C to all of its processes.
+// The interactive shell stays in the process group of gosh instead, as it does the job control on its own.
+//
+// When ctx is canceled, the processes are sent SIGTERM, and then SIGKILL after killAfter.
+func runProcess(ctx context.Context, cmd *exec.Cmd, interactive bool, killAfter time.Duration) error {
+	p, err := startProcess(ctx, cmd, interactive)
+	if err != nil {
+		return err
+	}
+
+	return p.wait(ctx, killAfter)
+}
+
+// startProcess starts cmd like runProcess does, and returns the process to wait for.
+func startProcess(ctx context.Context, cmd *exec.Cmd, interactive bool) (*process, error) {
+	group := !interactive
+
+	if group {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+
+		cmd.SysProcAttr.Setpgid = true
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+
+	tty, err := startInForeground(cmd, group)
+	if err != nil {
+		signal.Stop(signals)
+		return nil, err
+	}
+
+	p := &process{pid: cmd.Process.Pid, group: group, cmd: cmd, signals: signals, tty: tty}
+	p.untrack = trackProcess(ctx, p)
+
+	return p, nil
+}
+
+// wait waits for the process started by startProcess to exit, relaying the signals sent to gosh to it.
+// When ctx is canceled, the processes are sent SIGTERM, and then SIGKILL after killAfter.
+func (p *process) wait(ctx context.Context, killAfter time.Duration) error {
+	// Stop relaying signals once the process exits, so that gosh embedded in a long-lived program
+	// doesn't leak the handlers and keeps the default behavior between runs.
+	defer signal.Stop(p.signals)
+	defer p.untrack()
+
+	if p.tty >= 0 {
+		defer takeForeground(p.tty, p.pid)
+	}
+
+	exited := make(chan struct{})
+	waitErr := make(chan error, 1)
+
+	go func() {
+		waitErr <- p.cmd.Wait()
+		close(exited)
+	}()
+
+	done := ctx.Done()
+
+	for {
+		select {
+		case sig := <-p.signals:
+			// The terminal has already sent it to every process in the foreground process group, which includes gosh
+			if !p.group && (sig == syscall.SIGINT || sig == syscall.SIGQUIT) {
+				continue
+			}
+
+			p.signal(sig.(syscall.Signal))
+		case <-done:
+			done = nil
+
+			go p.terminate(exited, killAfter)
+		case err := <-waitErr:
+			return err
+		}
+	}
+}
+
+// signal sends sig to the process, or to all the processes in its group.
+func (p *process) signal(sig syscall.Signal) error {
+	if p.group {
+		return syscall.Kill(-p.pid, sig)
+	}
+
+	return syscall.Kill(p.pid, sig)
+}
+
+// terminate sends SIGTERM to the processes, and SIGKILL to the ones that are still alive after killAfter.
+func (p *process) terminate(exited <-chan struct{}, killAfter time.Duration) {
+	p.signal(syscall.SIGTERM)
+
+	timeout := time.NewTimer(killAfter)
+	defer timeout.Stop()
+
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-timeout.C:
+			p.signal(syscall.SIGKILL)
+			return
+		case <-exited:
+			if !p.group {
+				return
+			}
+
+			// Wait for the rest of the group, which may have outlived the leader
+			exited = nil
+		case <-tick.C:
+			if exited == nil && syscall.Kill(-p.pid, 0) == syscall.ESRCH {
+				return
+			}
+		}
+	}
+}
+
+// startInForeground starts cmd, putting its process group in the foreground of the terminal when its stdin is the one gosh is in the foreground of.
+// It returns the fd of the terminal, or -1 when it didn't.
+func startInForeground(cmd *exec.Cmd, group bool) (int, error) {
+	terminalMu.Lock()
+	defer terminalMu.Unlock()
+
+	tty := -1
+
+	if f, ok := cmd.Stdin.(*os.File); ok && group && isForeground(int(f.Fd())) {
+		tty = int(f.Fd())
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = tty
+	}
+
+	return tty, cmd.Start()
+}
+
+// isForeground returns true when fd is the controlling terminal of gosh, and gosh is in its foreground process group.
+func isForeground(fd int) bool {
+	if !terminal.IsTerminal(fd) {
+		return false
+	}
+
+	pgrp, err := tcgetpgrp(fd)
+
+	return err == nil && pgrp == syscall.Getpgrp()
+}
+
+// takeForeground puts the process group of gosh back in the foreground of the terminal,
+// unless the process group of the command at pid has already left it, like when another command took it over.
+func takeForeground(fd, pid int) {
+	terminalMu.Lock()
+	defer terminalMu.Unlock()
+
+	if pgrp, err := tcgetpgrp(fd); err != nil || pgrp != pid {
+		return
+	}
+
+	// gosh is now in a background process group, which is stopped by SIGTTOU on changing the foreground one, unless it's ignored
+	if !signal.Ignored(syscall.SIGTTOU) {
+		signal.Ignore(syscall.SIGTTOU)
+		defer signal.Reset(syscall.SIGTTOU)
+	}
+
+	tcsetpgrp(fd, syscall.Getpgrp())
+}
+
+func tcgetpgrp(fd int) (int, error) {
+	var pgrp int32
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp))); errno != 0 {
+		return 0, errno
+	}
+
+	return int(pgrp), nil
+}
+
+func tcsetpgrp(fd, pgrp int) error {
+	p := int32(pgrp)
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCSPGRP), uintptr(unsafe.Pointer(&p))); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
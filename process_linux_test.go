@@ -0,0 +1,62 @@
+package gosh_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutWithTerminal(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	goshtest.Run(t, sh, func() {
+		tty := openPty(t)
+
+		var stdout bytes.Buffer
+
+		start := time.Now()
+
+		// The grandchild holds the captured stdout, which must not keep Run waiting
+		err := sh.Run(t, "bash", "-c", "sleep 30 & wait", gosh.ReadStdin(tty), gosh.WriteStdout(&stdout), gosh.Timeout(200*time.Millisecond))
+
+		assert.Error(t, err)
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "must terminate the grandchild along with the command")
+	})
+}
+
+// openPty returns the slave side of a new pseudo terminal.
+func openPty(t *testing.T) *os.File {
+	t.Helper()
+
+	ptmx, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("unable to open a pseudo terminal: %v", err)
+	}
+	t.Cleanup(func() { ptmx.Close() })
+
+	var unlock int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ptmx.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	var n uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ptmx.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		t.Fatal(errno)
+	}
+
+	tty, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tty.Close() })
+
+	return tty
+}
@@ -0,0 +1,109 @@
+package gosh_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/context"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancel(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	goshtest.Run(t, sh, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		time.AfterFunc(500*time.Millisecond, cancel)
+
+		var stdout bytes.Buffer
+
+		start := time.Now()
+
+		err := sh.Run(t, ctx, "bash", "-c", "sleep 30 & jobs -p; wait", gosh.WriteStdout(&stdout))
+
+		assert.Error(t, err)
+		assert.Less(t, int64(time.Since(start)), int64(gosh.DefaultKillAfter), "must not wait for the grandchild to exit")
+
+		pid, err := strconv.Atoi(strings.TrimSpace(stdout.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The grandchild may be left as a zombie when there's no init process that reaps it
+		stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if err == nil {
+			assert.Contains(t, string(stat), ") Z ", "the grandchild must be terminated")
+		}
+	})
+}
+
+func TestTimeout(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	goshtest.Run(t, sh, func() {
+		start := time.Now()
+
+		err := sh.Run(t, "sleep", "30", gosh.Timeout(200*time.Millisecond))
+
+		var timeoutErr *gosh.TimeoutError
+		if assert.True(t, errors.As(err, &timeoutErr)) {
+			assert.Equal(t, 200*time.Millisecond, timeoutErr.Timeout)
+			assert.Equal(t, 124, timeoutErr.ExitCode())
+		}
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.Less(t, int64(time.Since(start)), int64(10*time.Second))
+
+		// SIGKILL follows SIGTERM, which is ignored
+		start = time.Now()
+
+		err = sh.Run(t, "bash", "-c", "trap '' TERM; sleep 30", gosh.Timeout(200*time.Millisecond), gosh.KillAfter(200*time.Millisecond))
+
+		var exitErr *gosh.ExitError
+		if assert.True(t, errors.As(err, &exitErr)) {
+			assert.Equal(t, syscall.SIGKILL, exitErr.Signal)
+		}
+		assert.Less(t, int64(time.Since(start)), int64(gosh.DefaultKillAfter))
+
+		assert.NoError(t, sh.Run(t, "true", gosh.Timeout(10*time.Second)))
+	})
+}
+
+func TestCleanEnv(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("hello", func() {})
+
+	goshtest.Run(t, sh, func() {
+		t.Setenv("GOSH_TEST_LEAK", "leaked")
+
+		var env string
+
+		err := sh.Run(t, "sh", "-c", "env", gosh.CleanEnv(), gosh.Env("FOO=bar"), gosh.OutString(&env))
+		assert.NoError(t, err)
+		assert.Contains(t, env, "FOO=bar")
+		assert.NotContains(t, env, "GOSH_TEST_LEAK")
+		assert.NotContains(t, env, "HOME=")
+
+		err = sh.Run(t, "sh", "-c", "env", gosh.InheritEnv("PATH", "HOME"), gosh.OutString(&env))
+		assert.NoError(t, err)
+		assert.Contains(t, env, "PATH=")
+		assert.Contains(t, env, "HOME=")
+		assert.NotContains(t, env, "GOSH_TEST_LEAK")
+
+		// The shims of the exported functions are put on PATH without an empty entry that searches the working directory
+		var path string
+
+		err = sh.Run(t, gosh.Script(`echo "$PATH"`), gosh.CleanEnv(), gosh.Env("PATH="), gosh.OutString(&path), gosh.WriteStderr(ioutil.Discard))
+		assert.NoError(t, err)
+		assert.NotContains(t, path, ":")
+	})
+}
@@ -11,7 +11,7 @@ import (
 
 // dsl
 var (
-	sh       = &Shell{}
+	sh       = New(Config{BuildTags: []string{"project"}})
 	Task     = sh.Export
 	Run      = sh.Run
 	MustExec = sh.MustExec
@@ -22,7 +22,7 @@ func init() {
 
 	})
 
-	Task("build", func(ctx context.Context) {
+	Task("build", func(ctx context.Context) error {
 		var examples = []string{
 			"arctest",
 			"commands",
@@ -34,9 +34,13 @@ func init() {
 
 		const dir = "examples"
 
+		var builds []Command
+
 		for _, name := range examples {
-			Run(ctx, "go", "build", "-o", "bin/"+name, "./"+name, Dir(dir))
+			builds = append(builds, Cmd("go", "build", "-o", "bin/"+name, "./"+name, Dir(dir)))
 		}
+
+		return sh.Parallel(ctx, 4, builds...)
 	})
 
 	Task("test", func() {
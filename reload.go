@@ -0,0 +1,542 @@
+package gosh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mumoshu/gosh/context"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// The interactive shell hot-reloads the gosh application by asking the active binary,
+// before every command, to "reload" itself.
+// The active binary computes a fingerprint of the Go source files the application depends on,
+// and rebuilds the application into a cache directory only when there's no binary for the fingerprint yet.
+// It then prints the script to switch to the binary for the fingerprint, if it isn't the active one.
+//
+// When the build fails, the active binary is kept as is. The failure is recorded per fingerprint,
+// so that the compile errors are shown only once per failed revision, and exposed via $GOSH_BUILD_STATUS
+// to be used in the prompt.
+
+const (
+	// reloadArg is the subcommand to reload the app, which is called by the reload hook
+	reloadArg = "__reload"
+
+	// reloadForceFlag forces rebuilding the app even if the sources didn't change
+	reloadForceFlag = "-force"
+
+	// reloadBuiltin is the shell function to force reloading the app
+	reloadBuiltin = "reload"
+
+	// BuildStatusVar is the shell variable set to "failed" while the last hot reload failed to build the app.
+	// It's empty otherwise.
+	BuildStatusVar = "GOSH_BUILD_STATUS"
+
+	// maxBuildErrors is the max number of compile errors shown on a failed hot reload
+	maxBuildErrors = 10
+
+	// pruneAge is how long a binary is kept after it was last used, so that the other sessions are able to keep using it
+	pruneAge = 24 * time.Hour
+)
+
+// buildError is returned when the app failed to build on hot reload.
+type buildError struct {
+	summary string
+
+	// fresh is true when this is the first failure for the revision
+	fresh bool
+}
+
+func (e *buildError) Error() string {
+	return e.summary
+}
+
+type reloader struct {
+	pkg       string
+	buildArgs []string
+
+	// dir is the cache directory dedicated to the pair of pkg and buildArgs.
+	// It contains the list of inputs to the fingerprint, and a subdirectory per fingerprint containing the binary.
+	dir string
+}
+
+func (c *App) reloader() (*reloader, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	buildArgs := c.buildArgs()
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", c.Pkg, strings.Join(buildArgs, " "))
+	key := hex.EncodeToString(h.Sum(nil))[:16]
+
+	return &reloader{
+		pkg:       c.Pkg,
+		buildArgs: buildArgs,
+		dir:       filepath.Join(cacheDir, "gosh", key),
+	}, nil
+}
+
+// buildArgs returns the flags to `go build` and `go list` the app with.
+func (c *App) buildArgs() []string {
+	var buildArgs []string
+
+	if len(c.BuildTags) > 0 {
+		buildArgs = append(buildArgs, "-tags="+strings.Join(c.BuildTags, ","))
+	}
+
+	return append(buildArgs, c.BuildFlags...)
+}
+
+// reload writes the script to switch to the up-to-date binary to w.
+// It writes nothing when the active binary is up to date.
+func (c *App) reload(ctx context.Context, w io.Writer, force bool) error {
+	r, err := c.reloader()
+	if err != nil {
+		return err
+	}
+
+	bin, err := r.binary(ctx, force)
+
+	var buildErr *buildError
+	if errors.As(err, &buildErr) {
+		if buildErr.fresh {
+			stderr := context.Stderr(ctx)
+			fmt.Fprint(stderr, colorizeBuildError(stderr, r.pkg, buildErr.summary))
+		}
+
+		fmt.Fprintf(w, "%s=failed\n", BuildStatusVar)
+
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s=\n", BuildStatusVar)
+
+	r.touch(bin)
+
+	if sameFile(bin, c.SelfPath) {
+		return nil
+	}
+
+	fmt.Fprintf(w, "eval \"$(%s env)\"\n", shellQuote(bin))
+
+	r.prune(bin, c.SelfPath)
+
+	return nil
+}
+
+// adopt makes the running binary the one for the current fingerprint, if there's none yet.
+// This saves us from rebuilding the app on the first command in an interactive session started via `go run`.
+func (c *App) adopt(ctx context.Context) error {
+	r, err := c.reloader()
+	if err != nil {
+		return err
+	}
+
+	inputs, err := r.inputs(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	bin := r.path(fingerprint(inputs))
+
+	if _, err := os.Stat(bin); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(bin), 0755); err != nil {
+		return err
+	}
+
+	return linkOrCopy(c.SelfPath, bin)
+}
+
+// linkOrCopy hard links src to dst, or copies it when they're on different filesystems.
+// A hard link lets the dispatcher know that the adopted binary is itself, while the copy is switched to on the next reload.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Rename it only after it's fully written, so that a partially written binary is never used.
+	return os.Rename(tmp, dst)
+}
+
+func (r *reloader) path(fp string) string {
+	return filepath.Join(r.dir, fp, appName())
+}
+
+// binary returns the path to the binary built from the current sources, building it if necessary.
+func (r *reloader) binary(ctx context.Context, force bool) (string, error) {
+	cached, err := r.inputs(ctx, false)
+	if err != nil {
+		return "", err
+	}
+
+	bin := r.path(fingerprint(cached))
+
+	if !force {
+		if _, err := os.Stat(bin); err == nil {
+			return bin, nil
+		}
+
+		if err := r.failure(bin); err != nil {
+			return "", err
+		}
+	}
+
+	// The dependencies may have changed along with the sources.
+	// `go list` fails on e.g. a syntax error, in which case we let `go build` report it.
+	inputs, err := r.inputs(ctx, true)
+	if err != nil {
+		inputs = cached
+	}
+
+	bin = r.path(fingerprint(inputs))
+
+	if !force {
+		if _, err := os.Stat(bin); err == nil {
+			return bin, nil
+		}
+
+		if err := r.failure(bin); err != nil {
+			return "", err
+		}
+	}
+
+	if err := r.build(ctx, bin); err != nil {
+		return "", err
+	}
+
+	return bin, nil
+}
+
+// failure returns the recorded build error for the revision the binary is built from, if any.
+func (r *reloader) failure(bin string) error {
+	summary, err := ioutil.ReadFile(failureFile(bin))
+	if err != nil {
+		return nil
+	}
+
+	return &buildError{summary: string(summary)}
+}
+
+func failureFile(bin string) string {
+	return filepath.Join(filepath.Dir(bin), "failed")
+}
+
+func (r *reloader) build(ctx context.Context, bin string) error {
+	tmp := bin + ".tmp"
+
+	args := append([]string{"build", "-o", tmp}, r.buildArgs...)
+	args = append(args, ".")
+
+	if err := os.MkdirAll(filepath.Dir(bin), 0755); err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = r.pkg
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmp)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		summary := summarizeBuildOutput(out.String())
+		if summary == "" {
+			summary = err.Error()
+		}
+
+		// Record it so that we won't rebuild nor show the errors again until the sources change
+		ioutil.WriteFile(failureFile(bin), []byte(summary), 0644)
+
+		return &buildError{summary: summary, fresh: true}
+	}
+
+	os.Remove(failureFile(bin))
+
+	// Rename it only after a successful build, so that a partially written binary is never used.
+	return os.Rename(tmp, bin)
+}
+
+// summarizeBuildOutput extracts up to maxBuildErrors errors from the output of `go build`,
+// omitting package headers like `# example.com/foo`.
+func summarizeBuildOutput(out string) string {
+	var errs []string
+
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "# ") {
+			continue
+		}
+
+		errs = append(errs, line)
+	}
+
+	if len(errs) > maxBuildErrors {
+		more := len(errs) - maxBuildErrors
+		errs = append(errs[:maxBuildErrors], fmt.Sprintf("... and %d more", more))
+	}
+
+	if len(errs) == 0 {
+		return ""
+	}
+
+	return strings.Join(errs, "\n") + "\n"
+}
+
+func colorizeBuildError(w io.Writer, pkg, summary string) string {
+	header := fmt.Sprintf("gosh: failed to rebuild %s. Keeping the last good binary.", pkg)
+
+	if f, ok := w.(*os.File); !ok || !terminal.IsTerminal(int(f.Fd())) {
+		return header + "\n" + summary
+	}
+
+	const (
+		red   = "\x1b[31m"
+		bold  = "\x1b[1m"
+		reset = "\x1b[0m"
+	)
+
+	var b strings.Builder
+
+	b.WriteString(bold + red + header + reset + "\n")
+
+	for _, line := range strings.Split(strings.TrimSuffix(summary, "\n"), "\n") {
+		// Highlight the position part of `./main.go:12:3: undefined: foo`
+		if i := strings.Index(line, ": "); i > 0 && strings.Contains(line[:i], ".go:") {
+			line = bold + line[:i] + reset + ":" + red + line[i+1:] + reset
+		}
+
+		b.WriteString(line + "\n")
+	}
+
+	return b.String()
+}
+
+// inputs returns the files and directories the fingerprint is computed from.
+// They're cached in the cache directory, and refreshed by running `go list` only when refresh is true
+// or there's no cache yet.
+func (r *reloader) inputs(ctx context.Context, refresh bool) ([]string, error) {
+	listFile := filepath.Join(r.dir, "inputs")
+
+	if !refresh {
+		if data, err := ioutil.ReadFile(listFile); err == nil {
+			return strings.Split(strings.TrimSpace(string(data)), "\n"), nil
+		}
+	}
+
+	inputs, err := r.listInputs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(listFile, []byte(strings.Join(inputs, "\n")+"\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	return inputs, nil
+}
+
+// listInputs lists the directories of the non-standard packages the app depends on, along with their go.mod and go.sum files.
+// go.work and go.work.sum are included too when the app is built in a Go workspace.
+// Packages in the module cache are omitted, as they never change without go.sum being changed.
+func (r *reloader) listInputs(ctx context.Context) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+
+	goEnv := exec.CommandContext(ctx, "go", "env", "GOMODCACHE", "GOWORK")
+	goEnv.Dir = r.pkg
+
+	goEnvOut, err := goEnv.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go env GOMODCACHE GOWORK: %w", err)
+	}
+
+	goEnvs := strings.Split(string(goEnvOut), "\n")
+
+	args := append([]string{"list", "-deps", "-f", "{{if not .Standard}}{{.Dir}}\t{{with .Module}}{{.GoMod}}{{end}}{{end}}"}, r.buildArgs...)
+	args = append(args, ".")
+
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = r.pkg
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("go %s: %w: %s", strings.Join(args, " "), err, stderr.String())
+	}
+
+	modCacheDir := strings.TrimSpace(goEnvs[0])
+
+	set := map[string]struct{}{}
+
+	// GOWORK is empty outside of a workspace, or "off" when it's disabled
+	if len(goEnvs) > 1 {
+		if goWork := strings.TrimSpace(goEnvs[1]); goWork != "" && goWork != "off" {
+			set[goWork] = struct{}{}
+			set[goWork+".sum"] = struct{}{}
+		}
+	}
+
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if fields[0] == "" {
+			continue
+		}
+
+		if modCacheDir != "" && strings.HasPrefix(fields[0], modCacheDir+string(filepath.Separator)) {
+			continue
+		}
+
+		set[fields[0]] = struct{}{}
+
+		if len(fields) > 1 && fields[1] != "" {
+			set[fields[1]] = struct{}{}
+			set[filepath.Join(filepath.Dir(fields[1]), "go.sum")] = struct{}{}
+		}
+	}
+
+	var inputs []string
+	for in := range set {
+		inputs = append(inputs, in)
+	}
+
+	sort.Strings(inputs)
+
+	return inputs, nil
+}
+
+// fingerprint hashes the names, sizes and modification times of the inputs.
+// A directory contributes its Go source files.
+func fingerprint(inputs []string) string {
+	h := sha256.New()
+
+	for _, in := range inputs {
+		info, err := os.Stat(in)
+		if err != nil {
+			fmt.Fprintf(h, "%s\tmissing\n", in)
+			continue
+		}
+
+		if !info.IsDir() {
+			fmt.Fprintf(h, "%s\t%d\t%d\n", in, info.Size(), info.ModTime().UnixNano())
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(in)
+		if err != nil {
+			fmt.Fprintf(h, "%s\tunreadable\n", in)
+			continue
+		}
+
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(e.Name(), ".go") {
+				continue
+			}
+
+			fmt.Fprintf(h, "%s\t%d\t%d\n", filepath.Join(in, e.Name()), e.Size(), e.ModTime().UnixNano())
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// touch marks the binary as used now, so that it's kept by prune for pruneAge.
+func (r *reloader) touch(bin string) {
+	now := time.Now()
+
+	os.Chtimes(filepath.Dir(bin), now, now)
+}
+
+// prune removes binaries that are unused for pruneAge, other than the ones given.
+// The ones used recently are kept, as they may still be the active ones in other sessions.
+func (r *reloader) prune(keep ...string) {
+	entries, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return
+	}
+
+	keepDirs := map[string]struct{}{}
+	for _, k := range keep {
+		keepDirs[filepath.Dir(k)] = struct{}{}
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || time.Since(e.ModTime()) < pruneAge {
+			continue
+		}
+
+		d := filepath.Join(r.dir, e.Name())
+		if _, ok := keepDirs[d]; ok {
+			continue
+		}
+
+		os.RemoveAll(d)
+	}
+}
+
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(ai, bi)
+}
@@ -0,0 +1,159 @@
+package gosh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprint(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(name, content string, mtime time.Time) {
+		t.Helper()
+
+		p := filepath.Join(dir, name)
+
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+
+	write("main.go", "package main", now)
+	write("README.md", "readme", now)
+
+	inputs := []string{dir, filepath.Join(dir, "go.mod")}
+
+	fp := fingerprint(inputs)
+
+	assert.Equal(t, fp, fingerprint(inputs), "fingerprint must be stable")
+
+	write("README.md", "updated readme", now.Add(time.Second))
+	assert.Equal(t, fp, fingerprint(inputs), "non-go files must be ignored")
+
+	write("go.mod", "module example.com/foo", now)
+	withGoMod := fingerprint(inputs)
+	assert.NotEqual(t, fp, withGoMod, "go.mod must be taken into account")
+
+	write("main.go", "package main // updated", now.Add(time.Second))
+	assert.NotEqual(t, withGoMod, fingerprint(inputs), "go files must be taken into account")
+}
+
+func TestSummarizeBuildOutput(t *testing.T) {
+	out := "# example.com/foo\n"
+	for i := 1; i <= 12; i++ {
+		out += fmt.Sprintf("./main.go:%d:1: undefined: foo\n", i)
+	}
+
+	summary := summarizeBuildOutput(out)
+	lines := strings.Split(strings.TrimSuffix(summary, "\n"), "\n")
+
+	assert.Len(t, lines, maxBuildErrors+1)
+	assert.Equal(t, "./main.go:1:1: undefined: foo", lines[0])
+	assert.Equal(t, "... and 2 more", lines[maxBuildErrors])
+
+	assert.Equal(t, "", summarizeBuildOutput("# example.com/foo\n\n"))
+}
+
+func TestPrune(t *testing.T) {
+	r := &reloader{dir: t.TempDir()}
+
+	old := time.Now().Add(-2 * pruneAge)
+
+	bin := func(fp string, used time.Time) string {
+		t.Helper()
+
+		p := r.path(fp)
+
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(p, []byte(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Chtimes(filepath.Dir(p), used, used); err != nil {
+			t.Fatal(err)
+		}
+
+		return p
+	}
+
+	unused := bin("unused", old)
+	recent := bin("recent", time.Now())
+	active := bin("active", old)
+	touched := bin("touched", old)
+
+	r.touch(touched)
+	r.prune(active)
+
+	assert.NoFileExists(t, unused)
+	assert.FileExists(t, recent, "a binary used recently may be the active one in another session")
+	assert.FileExists(t, active)
+	assert.FileExists(t, touched)
+}
+
+func TestLinkOrCopy(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "app")
+
+	if err := ioutil.WriteFile(src, []byte("binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("same filesystem", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "app")
+
+		assert.NoError(t, linkOrCopy(src, dst))
+		assert.True(t, sameFile(src, dst))
+	})
+
+	t.Run("different filesystems", func(t *testing.T) {
+		dir, err := ioutil.TempDir("/dev/shm", "gosh")
+		if err != nil {
+			t.Skipf("no tmpfs at /dev/shm: %v", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		dst := filepath.Join(dir, "app")
+
+		if err := os.Link(src, dst); err == nil {
+			t.Skip("/dev/shm is on the same filesystem")
+		}
+
+		assert.NoError(t, linkOrCopy(src, dst))
+
+		data, err := ioutil.ReadFile(dst)
+		assert.NoError(t, err)
+		assert.Equal(t, "binary", string(data))
+
+		info, err := os.Stat(dst)
+		if assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+		}
+
+		assert.NoFileExists(t, dst+".tmp")
+	})
+}
+
+func TestBuildArgs(t *testing.T) {
+	t.Setenv(buildTagEnv, "project,integration")
+
+	app := &App{BuildTags: Config{}.buildTags(), BuildFlags: []string{"-race"}}
+	assert.Equal(t, []string{"-tags=project,integration", "-race"}, app.buildArgs())
+
+	app = &App{BuildTags: Config{BuildTags: []string{"other"}}.buildTags()}
+	assert.Equal(t, []string{"-tags=other"}, app.buildArgs(), "the config takes precedence over the envvar")
+}
@@ -7,10 +7,11 @@ import (
 	"strings"
 
 	"github.com/mumoshu/gosh"
-	. "github.com/mumoshu/gosh"
 	"github.com/mumoshu/gosh/context"
 )
 
+var dirKey = context.NewKey[string]("dir")
+
 func New() *gosh.Shell {
 	sh := &gosh.Shell{}
 
@@ -18,12 +19,17 @@ func New() *gosh.Shell {
 		fmt.Fprintf(context.Stdout(ctx), "running setup1\n")
 	})
 
-	sh.Export("setup2", func(ctx context.Context, s []string) {
-		context.Set(ctx, "dir", s[0])
+	sh.Export("setup2", func(ctx context.Context, s []string) error {
+		if err := dirKey.Set(ctx, s[0]); err != nil {
+			return err
+		}
+
+		// Make it visible to foo, which depends on this function
+		return dirKey.Export(ctx)
 	})
 
 	sh.Export("foo", func(ctx context.Context, s []string) {
-		dir := context.Get(ctx, "dir").(string)
+		dir := dirKey.Get(ctx)
 
 		fmt.Fprintf(context.Stdout(ctx), "dir="+dir+"\n")
 		fmt.Fprintf(context.Stdout(ctx), strings.Join(s, " ")+"\n")
@@ -31,7 +37,7 @@ func New() *gosh.Shell {
 		// fmt.Fprintf(os.Stdout, strings.Join(s, " ")+"\n")
 		// fmt.Fprintf(os.Stdout, strings.Join(s, " ")+"\n")
 		// fmt.Fprintf(os.Stdout, strings.Join(s, " "))
-	}, Dep("setup1"), Dep("setup2", "aa"))
+	}, gosh.Dep("setup1"), gosh.Dep("setup2", "aa"))
 
 	sh.Export("hello", func(sub string) {
 		println("hello " + sub)
@@ -85,11 +91,11 @@ func New() *gosh.Shell {
 	})
 
 	sh.Export("ctx4", func(ctx context.Context) error {
-		return sh.Run(ctx, Cmd("ls", "-lah"), Cmd("grep", "test"))
+		return sh.Run(ctx, gosh.Cmd("ls", "-lah"), gosh.Cmd("grep", "test"))
 	})
 
 	sh.Export("ctx5", func(ctx context.Context) error {
-		return sh.Run(ctx, Cmd("bash -c 'ls -lah | grep test'"))
+		return sh.Run(ctx, gosh.Cmd("ls", "-lah"), gosh.Cmd("grep", "test"))
 	})
 
 	return sh
@@ -0,0 +1,283 @@
+package gosh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// Scripts run by gosh report their failures over the diagnostics channel, which is a high fd of the shell owned by gosh,
+// so that it never conflicts with the fds the scripts use, like fd 3 for the diagnostic logs.
+// The ERR trap installed by the env file writes a line per failed command, prefixed by scriptErrorPrefix,
+// while any other line is a diagnostic log to be forwarded to the diagnostics output of gosh.
+
+const (
+	// diagnosticsFD is the fd of the diagnostics channel in the shell
+	diagnosticsFD = 63
+
+	// diagnosticsFDEnv is the name of the envvar that points to diagnosticsFD
+	diagnosticsFDEnv = "GOSH_DIAGNOSTICS_FD"
+
+	// scriptErrorPrefix marks the line written by the ERR trap.
+	// The fields are the exit status, source file, line number, command, and function stack, separated by tabs.
+	scriptErrorPrefix = "gosh:err\t"
+
+	// syncPrefix marks the line written by a session after each command, followed by the sentinel,
+	// so that the session knows it has read all the failures reported by the command.
+	syncPrefix = "gosh:sync\t"
+
+	// diagnosticsDrainTimeout is how long gosh waits for the rest of the diagnostics after the shell exited.
+	// It's reached only when a background process outlives the shell while holding the channel.
+	diagnosticsDrainTimeout = 100 * time.Millisecond
+)
+
+// ScriptError is returned by Run when a shell script failed due to a failed command, like:
+//
+//	deploy.sh:42 in setup_cluster: kubectl apply -f manifest.yaml exited 1
+//
+// It's available only for the shells with the ERR trap, like bash.
+type ScriptError struct {
+	// Source is the path to the script file containing the failed command.
+	// It's empty when the command isn't in a file, like the one in a Script.
+	Source string
+
+	// Line is the line number of the failed command
+	Line int
+
+	// Command is the failed command
+	Command string
+
+	// Status is the exit status of the failed command
+	Status int
+
+	// Funcs is the stack of the shell functions that called the failed command, innermost first
+	Funcs []string
+
+	// Err is the error of the shell that ran the script, which is usually ExitError
+	Err error
+}
+
+func (e *ScriptError) Error() string {
+	loc := "line " + strconv.Itoa(e.Line)
+	if e.Source != "" {
+		loc = e.Source + ":" + strconv.Itoa(e.Line)
+	}
+
+	if len(e.Funcs) > 0 {
+		loc += " in " + e.Funcs[0]
+	}
+
+	// The command is printed as the shell saw it, which is already quoted where needed
+	return fmt.Sprintf("%s: %s exited %d", loc, e.Command, e.Status)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit status of the shell.
+func (e *ScriptError) ExitCode() int {
+	return exitCode(e.Err)
+}
+
+// ScriptErrorHook is a Go function called when Run failed due to a failed command in a shell script.
+type ScriptErrorHook func(ctx context.Context, err *ScriptError)
+
+// OnScriptError registers the hook to be called when Run failed due to a failed command in a shell script,
+// so that you can e.g. report or log the failure in your own way.
+func (t *Shell) OnScriptError(hook ScriptErrorHook) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.onScriptError = append(t.onScriptError, hook)
+}
+
+func (c *App) runScriptErrorHooks(ctx context.Context, err error) {
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) {
+		return
+	}
+
+	for _, h := range c.OnScriptError {
+		h(ctx, scriptErr)
+	}
+}
+
+func parseScriptError(line string) (*ScriptError, bool) {
+	fields := strings.Split(strings.TrimPrefix(line, scriptErrorPrefix), "\t")
+	if len(fields) != 5 {
+		return nil, false
+	}
+
+	status, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, false
+	}
+
+	lineNo, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, false
+	}
+
+	var funcs []string
+	for _, f := range strings.Fields(fields[4]) {
+		// The bottom of the stack of a script file
+		if f == "main" {
+			continue
+		}
+
+		funcs = append(funcs, f)
+	}
+
+	return &ScriptError{
+		Status:  status,
+		Source:  fields[1],
+		Line:    lineNo,
+		Command: fields[3],
+		Funcs:   funcs,
+	}, true
+}
+
+// diagnostics reads the diagnostics channel of a shell.
+type diagnostics struct {
+	r, w *os.File
+
+	done chan struct{}
+
+	// synced receives the sentinels written by a session after each command
+	synced chan string
+
+	mu sync.Mutex
+
+	// lastErr is the last failure reported by the ERR trap, which is likely to be the one that caused the shell to exit
+	lastErr *ScriptError
+}
+
+// newDiagnostics returns the diagnostics channel. Pass it to the shell with attach.
+func newDiagnostics() (*diagnostics, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &diagnostics{r: r, w: w, done: make(chan struct{}), synced: make(chan string, 1)}
+
+	go d.read()
+
+	return d, nil
+}
+
+// attach passes the channel to cmd as diagnosticsFD, following files passed as fd 3 and later.
+// fd 3 is the diagnostics output of gosh, if any, so that the scripts are able to write their diagnostic logs to it.
+func (d *diagnostics) attach(cmd *exec.Cmd, files ...*os.File) {
+	extra := make([]*os.File, diagnosticsFD-2)
+	extra[0] = diagsOut
+	copy(extra[1:], files)
+	extra[diagnosticsFD-3] = d.w
+
+	cmd.ExtraFiles = extra
+	cmd.Env = append(cmd.Env, diagnosticsFDEnv+"="+strconv.Itoa(diagnosticsFD))
+}
+
+// syncScript returns the script that marks the end of the failures reported by the commands preceding it.
+func syncScript(sentinel string) string {
+	return "{ printf '" + strings.TrimSuffix(syncPrefix, "\t") + "\\t%s\\n' " + shellQuote(sentinel) + " >&\"$" + diagnosticsFDEnv + "\"; } 2>/dev/null\n"
+}
+
+// sync waits until the mark written by syncScript is read, or exited is closed.
+func (d *diagnostics) sync(sentinel string, exited <-chan struct{}) {
+	for {
+		select {
+		case s := <-d.synced:
+			if s == sentinel {
+				return
+			}
+		case <-exited:
+			return
+		}
+	}
+}
+
+// takeErr returns the last failure reported so far, and forgets it.
+func (d *diagnostics) takeErr() *ScriptError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e := d.lastErr
+	d.lastErr = nil
+
+	return e
+}
+
+func (d *diagnostics) read() {
+	defer close(d.done)
+
+	scanner := bufio.NewScanner(d.r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, syncPrefix) {
+			d.synced <- strings.TrimPrefix(line, syncPrefix)
+
+			continue
+		}
+
+		if strings.HasPrefix(line, scriptErrorPrefix) {
+			if e, ok := parseScriptError(line); ok {
+				d.mu.Lock()
+				// The failed function call is reported again by its caller, with the same command and status.
+				// Keep the innermost one, which tells where it actually failed.
+				if l := d.lastErr; l == nil || l.Command != e.Command || l.Status != e.Status || len(l.Funcs) <= len(e.Funcs) {
+					d.lastErr = e
+				}
+				d.mu.Unlock()
+			}
+
+			continue
+		}
+
+		if diagsOut != nil {
+			fmt.Fprintln(diagsOut, line)
+		}
+	}
+}
+
+// close reads the rest of the diagnostics, and returns the ScriptError that explains err, if any.
+// Call it after the shell exited with err.
+func (d *diagnostics) close(err error) error {
+	d.w.Close()
+
+	select {
+	case <-d.done:
+	case <-time.After(diagnosticsDrainTimeout):
+		d.r.SetReadDeadline(time.Now())
+		<-d.done
+	}
+
+	d.r.Close()
+
+	if err == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	scriptErr := d.lastErr
+	d.mu.Unlock()
+
+	// The shell may have exited for another reason, like `exit 2` after a failed command
+	if scriptErr == nil || scriptErr.Status != exitCode(err) {
+		return err
+	}
+
+	scriptErr.Err = err
+
+	return scriptErr
+}
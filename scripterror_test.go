@@ -0,0 +1,117 @@
+package gosh_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/context"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScriptError(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	var hooked []*gosh.ScriptError
+
+	sh.OnScriptError(func(ctx context.Context, err *gosh.ScriptError) {
+		hooked = append(hooked, err)
+	})
+
+	goshtest.Run(t, sh, func() {
+		t.Run("script file", func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+
+			err := sh.Run(t, "testdata/deploy.sh", gosh.WriteStdout(&stdout), gosh.WriteStderr(&stderr))
+
+			var scriptErr *gosh.ScriptError
+			if !errors.As(err, &scriptErr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			assert.EqualError(t, err, "testdata/deploy.sh:5 in setup_cluster: ls /nonexistent exited 2")
+			assert.Equal(t, []string{"setup_cluster"}, scriptErr.Funcs)
+			assert.Equal(t, 2, scriptErr.ExitCode())
+
+			var exitErr *gosh.ExitError
+			if assert.True(t, errors.As(err, &exitErr)) {
+				assert.Contains(t, exitErr.Stderr, "No such file or directory")
+			}
+
+			assert.Equal(t, "setting up foo\n", stdout.String())
+			assert.Equal(t, []*gosh.ScriptError{scriptErr}, hooked)
+		})
+
+		t.Run("script", func(t *testing.T) {
+			err := sh.Run(t, gosh.Script("true\nfalse"))
+
+			assert.EqualError(t, err, "line 2: false exited 1")
+		})
+
+		t.Run("fd 3 of the script", func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out")
+
+			err := sh.Run(t, gosh.Script("exec 3>"+out+"; echo data >&3; false"))
+
+			var scriptErr *gosh.ScriptError
+			assert.True(t, errors.As(err, &scriptErr))
+
+			data, err := ioutil.ReadFile(out)
+			assert.NoError(t, err)
+			assert.Equal(t, "data\n", string(data))
+		})
+
+		t.Run("session", func(t *testing.T) {
+			session, err := sh.Session(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+
+			assert.NoError(t, session.Run(gosh.Script("false || true")))
+			assert.NoError(t, session.Run(gosh.Script("check() { ls /nonexistent; }")))
+
+			err = session.Run("check", gosh.WriteStderr(ioutil.Discard))
+
+			var scriptErr *gosh.ScriptError
+			if assert.True(t, errors.As(err, &scriptErr)) {
+				assert.Equal(t, "ls /nonexistent", scriptErr.Command)
+				assert.Equal(t, []string{"check"}, scriptErr.Funcs)
+				assert.Equal(t, "", scriptErr.Source)
+				assert.Equal(t, 2, scriptErr.ExitCode())
+			}
+
+			// The failure that didn't fail the command is forgotten
+			assert.NoError(t, session.Run(gosh.Script("false; true")))
+		})
+
+		t.Run("exited for another reason", func(t *testing.T) {
+			err := sh.Run(t, gosh.Script("false; exit 3"))
+
+			var scriptErr *gosh.ScriptError
+			assert.False(t, errors.As(err, &scriptErr))
+			assert.EqualError(t, err, "`false; exit 3` exited 3")
+		})
+	})
+}
+
+func TestNoErrTrap(t *testing.T) {
+	sh := &gosh.Shell{NoErrTrap: true}
+
+	goshtest.Run(t, sh, func() {
+		var out string
+
+		err := sh.Run(t, gosh.Script("shopt -o errtrace; true"), gosh.OutString(&out), gosh.WriteStdout(ioutil.Discard))
+		assert.NoError(t, err)
+		assert.Contains(t, out, "off")
+
+		err = sh.Run(t, gosh.Script("false"))
+
+		var scriptErr *gosh.ScriptError
+		assert.False(t, errors.As(err, &scriptErr))
+	})
+}
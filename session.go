@@ -0,0 +1,506 @@
+package gosh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// Session is a long-lived shell process that runs commands one after another.
+// Unlike Run, which spawns a shell per call, the commands run in a session share
+// the working directory, variables and functions, like they do in a shell script.
+//
+// The commands are sent to the shell over a pipe, and the end of the output of each command
+// is marked by a random sentinel followed by the exit status, so that the stdout and stderr of each command
+// are demultiplexed from the ones of the others.
+type Session struct {
+	app *App
+
+	cmd        *exec.Cmd
+	script     *os.File
+	envfile    string
+	dir        string
+	dispatcher *dispatcher
+	diags      *diagnostics
+
+	stdout *sentinelReader
+	stderr *sentinelReader
+
+	// sentinel is written after the output of each command
+	sentinel string
+
+	// defaultStdout and defaultStderr receive the output of the commands unless overridden per Run
+	defaultStdout io.Writer
+	defaultStderr io.Writer
+
+	exited  chan struct{}
+	waitErr error
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// Session starts a long-lived shell to run commands in.
+// vars can contain a context.Context, *testing.T, and RunOptions like Env, Dir and WriteStdout.
+//
+// The stdout and stderr of the context receive the output of the commands unless overridden per Session.Run.
+// Commands in the session read from the stdin of the context only when it's a file like os.Stdin,
+// and from /dev/null otherwise.
+//
+// Canceling the context terminates the shell along with all the commands it started.
+// Call Close to end the session.
+func (t *Shell) Session(vars ...interface{}) (*Session, error) {
+	var ctx context.Context
+	var testCtx *testing.T
+	var rc RunConfig
+
+	for _, v := range vars {
+		switch typed := v.(type) {
+		case context.Context:
+			ctx = typed
+		case *testing.T:
+			testCtx = typed
+		case RunOption:
+			typed(&rc)
+		default:
+			return nil, fmt.Errorf("unexpected arg to Session: %v(%T)", v, v)
+		}
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if rc.Stdout.w != nil {
+		ctx = context.WithStdout(ctx, rc.Stdout.w)
+	}
+
+	if rc.Stderr.w != nil {
+		ctx = context.WithStderr(ctx, rc.Stderr.w)
+	}
+
+	if testCtx != nil {
+		ctx = context.WithValue(ctx, testingTKey{}, testCtx)
+	}
+
+	if err := t.init(testCtx, nil); err != nil {
+		return nil, err
+	}
+
+	rc.Env = append(rc.Env, t.app.Env...)
+
+	return t.app.startSession(t.app.withRunConfig(ctx, rc))
+}
+
+func (c *App) startSession(ctx context.Context) (*Session, error) {
+	// The functions called in the session share the variables exported to the session
+	if !context.HasScope(ctx) {
+		ctx = context.WithScope(ctx)
+	}
+
+	sentinel, err := newSentinel()
+	if err != nil {
+		return nil, err
+	}
+
+	envfile, err := c.buildEnvfile(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	dispatcher, err := c.startDispatcher(ctx)
+	if err != nil {
+		os.Remove(envfile)
+		return nil, err
+	}
+
+	diags, err := newDiagnostics()
+	if err != nil {
+		dispatcher.Close()
+		os.Remove(envfile)
+		return nil, err
+	}
+
+	s := &Session{
+		app:           c,
+		envfile:       envfile,
+		dir:           context.Dir(ctx),
+		dispatcher:    dispatcher,
+		diags:         diags,
+		sentinel:      sentinel,
+		defaultStdout: context.Stdout(ctx),
+		defaultStderr: context.Stderr(ctx),
+		exited:        make(chan struct{}),
+	}
+
+	if err := s.start(ctx); err != nil {
+		s.cleanup()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Session) start(ctx context.Context) error {
+	scriptR, scriptW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer scriptR.Close()
+
+	// The shell reads the commands from fd 4 rather than stdin, so that the commands never consume them.
+	cmd := s.app.command(ctx, s.dispatcher, s.app.shellPath(), []string{"/dev/fd/4"}, nil)
+	s.diags.attach(cmd, scriptR)
+
+	if f, ok := cmd.Stdin.(*os.File); ok {
+		cmd.Stdin = f
+	} else {
+		cmd.Stdin = nil
+	}
+
+	cmd.Stdout = nil
+	cmd.Stderr = nil
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		scriptW.Close()
+		return err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		scriptW.Close()
+		return err
+	}
+
+	// The shell is started like any other command, so that the signals and the cancellation reach the commands it runs
+	p, err := startProcess(ctx, cmd, false)
+	if err != nil {
+		scriptW.Close()
+		return err
+	}
+
+	s.cmd = cmd
+	s.script = scriptW
+	s.stdout = &sentinelReader{r: stdout, sentinel: []byte(s.sentinel)}
+	s.stderr = &sentinelReader{r: stderr, sentinel: []byte(s.sentinel)}
+
+	go func() {
+		// Wait closes the pipes after the process exits, which unblocks any pending Run
+		s.waitErr = p.wait(ctx, killAfter(ctx))
+		close(s.exited)
+	}()
+
+	// Don't leak the fd to the commands
+	preamble := "exec 4<&-\n. " + shellQuote(s.envfile) + "\n"
+
+	_, _, err = s.send(preamble, s.defaultStdout, s.defaultStderr)
+
+	return err
+}
+
+// Run runs the command in the session, and waits for it to finish.
+// vars can contain strings, string slices and Scripts that form the command, and sinks like WriteStdout and WriteStderr.
+// Each string is passed as a separate word, whereas a Script is interpreted by the shell, like Run(Script("f() { echo hi; }")).
+//
+// Env and Dir apply only to the command, which runs in a subshell then, so that it never changes the env
+// and the working directory of the session. A relative Dir is relative to the working directory of the session.
+// Timeout, KillAfter, CleanEnv and InheritEnv are rejected, as the commands share the shell of the session.
+//
+// It returns ExitError when the command exits with a non-zero status.
+func (s *Session) Run(vars ...interface{}) error {
+	var args []string
+	var scripts []int
+	var rc RunConfig
+
+	for _, v := range vars {
+		switch typed := v.(type) {
+		case string:
+			args = append(args, typed)
+		case []string:
+			args = append(args, typed...)
+		case Script:
+			// Inserted as is, so that the shell interprets it
+			args = append(args, string(typed))
+			scripts = append(scripts, len(args)-1)
+		case StdoutSink:
+			rc.Stdout = typed
+		case StderrSink:
+			rc.Stderr = typed
+		case RunOption:
+			typed(&rc)
+		default:
+			return fmt.Errorf("unexpected arg to Session.Run: %v(%T)", v, v)
+		}
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("missing command")
+	}
+
+	if rc.Stdin.isSet() {
+		return fmt.Errorf("stdin can't be given per Session.Run, as the commands share the stdin of the session")
+	}
+
+	// The shell runs the commands one after another, so there's no way to terminate only one of them
+	if rc.Timeout > 0 || rc.KillAfter > 0 {
+		return fmt.Errorf("timeout can't be given per Session.Run, as the commands run in the shell of the session. Cancel the context of the session instead")
+	}
+
+	if rc.CleanEnv || len(rc.InheritEnv) > 0 {
+		return fmt.Errorf("clean env can't be given per Session.Run, as the commands share the env of the session. Give it to Session instead")
+	}
+
+	// The working directory of the shell may have changed since the start, which gosh doesn't track
+	rc, closeStdout, err := openStdoutFile(rc, s.dir)
+	if err != nil {
+		return err
+	}
+	defer closeStdout()
+
+	words := make([]string, len(args))
+	for i, a := range args {
+		words[i] = shellWord(a, i == 0)
+	}
+	for _, i := range scripts {
+		words[i] = args[i]
+	}
+
+	ctx := context.WithStdout(context.Background(), s.defaultStdout)
+	ctx = context.WithStderr(ctx, s.defaultStderr)
+
+	// The stdout and stderr are read from different pipes, so WriteCombined doesn't keep the order in a session
+	ctx, explicitStdout, flushOutputs := withOutputs(ctx, rc)
+	defer flushOutputs()
+
+	ctx, decodeCaptures := withCaptures(ctx, rc.Captures, explicitStdout)
+
+	stderrTail := newTailWriter(context.Stderr(ctx), maxStderrTail)
+
+	status, scriptErr, err := s.send(withDirAndEnv(strings.Join(words, " "), rc.Dir, rc.Env)+"\n", context.Stdout(ctx), stderrTail)
+	if err != nil {
+		return err
+	}
+
+	if status != 0 {
+		exitErr := &ExitError{Command: args, Code: status, Stderr: stderrTail.String()}
+
+		// The command may have failed for another reason, like `exit 2` after a failed command
+		if scriptErr == nil || scriptErr.Status != status {
+			return exitErr
+		}
+
+		// The commands are read from the pipe, which isn't a file to point to
+		if scriptErr.Source == "/dev/fd/4" {
+			scriptErr.Source = ""
+		}
+
+		scriptErr.Err = exitErr
+
+		s.app.runScriptErrorHooks(ctx, scriptErr)
+
+		return scriptErr
+	}
+
+	return decodeCaptures()
+}
+
+// withDirAndEnv returns the command line that runs line in dir with env.
+// It runs in a subshell, so that dir and env never affect the rest of the session.
+func withDirAndEnv(line, dir string, env []string) string {
+	if dir == "" && len(env) == 0 {
+		return line
+	}
+
+	var setup []string
+
+	if dir != "" {
+		setup = append(setup, "cd "+shellQuote(dir))
+	}
+
+	for _, e := range env {
+		setup = append(setup, "export "+shellQuote(e))
+	}
+
+	// The line may end with a comment, which would otherwise comment out the closing parenthesis
+	return "(" + strings.Join(setup, " && ") + " &&\n" + line + "\n)"
+}
+
+// send writes the script to the shell followed by the sentinels, and copies the output to stdout and stderr
+// until the sentinels are read back.
+// It also returns the last failure reported by the ERR trap while running the script, if any.
+func (s *Session) send(script string, stdout, stderr io.Writer) (int, *ScriptError, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, nil, fmt.Errorf("session closed")
+	}
+
+	// Forget the failures of the previous commands that didn't fail them, like the one in `false || true`
+	s.diags.takeErr()
+
+	script += "_gosh_status=$?; " + syncScript(s.sentinel)
+	script += "printf '%s%d\\n' " + shellQuote(s.sentinel) + " \"$_gosh_status\"; printf '%s\\n' " + shellQuote(s.sentinel) + " >&2\n"
+
+	if _, err := io.WriteString(s.script, script); err != nil {
+		return 0, nil, s.exitedErr(err)
+	}
+
+	// The stdout and stderr may end up in the same writer, like with WriteCombined and Stderr2Stdout,
+	// which is written concurrently by the copiers below
+	var writeMu sync.Mutex
+	stdout = &lockedWriter{mu: &writeMu, w: stdout}
+	stderr = &lockedWriter{mu: &writeMu, w: stderr}
+
+	var stderrErr error
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, stderrErr = s.stderr.copyUntilSentinel(stderr)
+	}()
+
+	status, err := s.stdout.copyUntilSentinel(stdout)
+
+	wg.Wait()
+
+	if err != nil {
+		return 0, nil, s.exitedErr(err)
+	}
+
+	if stderrErr != nil {
+		return 0, nil, s.exitedErr(stderrErr)
+	}
+
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	s.diags.sync(s.sentinel, s.exited)
+
+	return code, s.diags.takeErr(), nil
+}
+
+// lockedWriter serializes the writes to w with the writes to the other writers sharing mu.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Write(p)
+}
+
+func (s *Session) exitedErr(err error) error {
+	<-s.exited
+
+	if s.waitErr != nil {
+		return fmt.Errorf("session exited: %w", s.waitErr)
+	}
+
+	return fmt.Errorf("session exited: %w", err)
+}
+
+// Close ends the session, waiting for the shell to exit.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+
+	// The shell exits on reading EOF
+	s.script.Close()
+
+	<-s.exited
+
+	s.cleanup()
+
+	if _, ok := s.waitErr.(*exec.ExitError); ok {
+		return newExitError([]string{s.app.shellPath()}, s.waitErr, nil)
+	}
+
+	return s.waitErr
+}
+
+func (s *Session) cleanup() {
+	s.dispatcher.Close()
+	s.diags.close(nil)
+
+	if !s.app.Debug {
+		os.Remove(s.envfile)
+	}
+}
+
+func newSentinel() (string, error) {
+	b := make([]byte, 8)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return "__gosh_" + hex.EncodeToString(b) + "__", nil
+}
+
+// sentinelReader splits the output of the session into the ones of the commands.
+type sentinelReader struct {
+	r        io.Reader
+	sentinel []byte
+
+	// pending is the data read but not yet written, which may contain a part of the sentinel
+	pending []byte
+}
+
+// copyUntilSentinel copies the output to w until the sentinel, and returns the rest of the line following it.
+func (r *sentinelReader) copyUntilSentinel(w io.Writer) (string, error) {
+	buf := make([]byte, 32*1024)
+
+	for {
+		if i := bytes.Index(r.pending, r.sentinel); i >= 0 {
+			if i > 0 {
+				w.Write(r.pending[:i])
+				r.pending = r.pending[i:]
+			}
+
+			if j := bytes.IndexByte(r.pending, '\n'); j >= 0 {
+				rest := string(r.pending[len(r.sentinel):j])
+				r.pending = r.pending[j+1:]
+
+				return rest, nil
+			}
+		} else if n := len(r.pending) - len(r.sentinel) + 1; n > 0 {
+			// Keep the tail that may be the beginning of the sentinel
+			w.Write(r.pending[:n])
+			r.pending = r.pending[n:]
+		}
+
+		n, err := r.r.Read(buf)
+		r.pending = append(r.pending, buf[:n]...)
+
+		if err != nil && n == 0 {
+			w.Write(r.pending)
+			r.pending = nil
+
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package gosh_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/context"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("hello", func(ctx context.Context, target string) {
+		context.Stdout(ctx).Write([]byte("hello " + target + "\n"))
+	})
+
+	goshtest.Run(t, sh, func() {
+		session, err := sh.Session(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.Close()
+
+		run := func(vars ...interface{}) (string, string, error) {
+			var stdout, stderr bytes.Buffer
+
+			err := session.Run(append(vars, gosh.WriteStdout(&stdout), gosh.WriteStderr(&stderr))...)
+
+			return stdout.String(), stderr.String(), err
+		}
+
+		_, _, err = run("cd", "/")
+		assert.NoError(t, err)
+
+		_, _, err = run("export", "FOO=foo")
+		assert.NoError(t, err)
+
+		err = session.Run(gosh.Script("greet() { printf 'hi %s' \"$1\"; echo oops >&2; }"))
+		assert.NoError(t, err)
+
+		stdout, stderr, err := run("pwd")
+		assert.NoError(t, err)
+		assert.Equal(t, "/\n", stdout)
+		assert.Equal(t, "", stderr)
+
+		stdout, _, err = run("printenv", "FOO")
+		assert.NoError(t, err)
+		assert.Equal(t, "foo\n", stdout)
+
+		var foo string
+		assert.NoError(t, session.Run("printenv", "FOO", gosh.OutString(&foo)))
+		assert.Equal(t, "foo", foo)
+
+		// The output without the trailing newline is demultiplexed, too
+		stdout, stderr, err = run("greet", "world")
+		assert.NoError(t, err)
+		assert.Equal(t, "hi world", stdout)
+		assert.Equal(t, "oops\n", stderr)
+
+		stdout, _, err = run("hello", "world")
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world\n", stdout)
+
+		_, stderr, err = run("eval", "echo failed >&2; false")
+
+		var exitErr *gosh.ExitError
+		if assert.True(t, errors.As(err, &exitErr)) {
+			assert.Equal(t, 1, exitErr.ExitCode())
+			assert.Equal(t, "failed\n", exitErr.Stderr)
+		}
+		assert.Equal(t, "failed\n", stderr)
+
+		// Env and Dir apply only to the command
+		stdout, _, err = run(gosh.Script(`echo "$(pwd) $FOO"`), gosh.Dir("/tmp"), gosh.Env("FOO=bar"))
+		assert.NoError(t, err)
+		assert.Equal(t, "/tmp bar\n", stdout)
+
+		stdout, _, err = run(gosh.Script(`echo "$(pwd) $FOO"`))
+		assert.NoError(t, err)
+		assert.Equal(t, "/ foo\n", stdout)
+
+		assert.Error(t, session.Run("sleep", "3", gosh.Timeout(100*time.Millisecond)))
+		assert.Error(t, session.Run("true", gosh.CleanEnv()))
+
+		// The stdout and stderr copied concurrently to the same writer
+		var combined bytes.Buffer
+		err = session.Run(gosh.Script("for i in 1 2 3; do echo out; echo err >&2; done"), gosh.Stderr2Stdout(), gosh.WriteStdout(&combined))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, strings.Count(combined.String(), "out\n"))
+		assert.Equal(t, 3, strings.Count(combined.String(), "err\n"))
+
+		assert.NoError(t, session.Close())
+
+		assert.Error(t, session.Run("pwd"))
+	})
+}
+
+func TestSessionExit(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	goshtest.Run(t, sh, func() {
+		session, err := sh.Session(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.EqualError(t, session.Run("exit", "3"), "session exited: exit status 3")
+
+		var exitErr *gosh.ExitError
+		if assert.True(t, errors.As(session.Close(), &exitErr)) {
+			assert.Equal(t, 3, exitErr.ExitCode())
+		}
+	})
+}
+
+func TestSessionCancel(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	goshtest.Run(t, sh, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		session, err := sh.Session(t, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		time.AfterFunc(200*time.Millisecond, cancel)
+
+		start := time.Now()
+
+		// The grandchild holds the stdout of the session, which must not keep Run waiting
+		assert.Error(t, session.Run(gosh.Script("sleep 30 & wait")))
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second), "must terminate the commands run by the session")
+
+		assert.Error(t, session.Close())
+	})
+}
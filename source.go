@@ -0,0 +1,117 @@
+package gosh
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// Source registers shell script files to be sourced into every shell spawned by gosh, including interactive sessions.
+// Each pattern is a glob relative to the working directory, like "lib/*.sh".
+//
+// The shell functions defined in the files can be called from Go via Run like any other command,
+// so that you can call not-yet-ported shell functions from Go, and exercise them individually from your tests.
+//
+// Source needs to be called before the first call to Run.
+func (t *Shell) Source(patterns ...string) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.sources = append(t.sources, patterns...)
+}
+
+// resolveSources returns the absolute paths to the files that match any of patterns.
+func resolveSources(dir string, patterns []string) ([]string, error) {
+	var files []string
+
+	for _, p := range patterns {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed globbing %s: %w", p, err)
+		}
+
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files to source matched %s", p)
+		}
+
+		files = append(files, matches...)
+	}
+
+	return files, nil
+}
+
+func (c *App) sourceScript() string {
+	var script string
+
+	for _, f := range c.Sources {
+		script += ". " + shellQuote(f) + "\n"
+	}
+
+	return script
+}
+
+// isShellFunc returns true when name is a shell function defined in any of the sourced files.
+func (c *App) isShellFunc(ctx context.Context, name string) (bool, error) {
+	c.shellFuncsMu.Lock()
+	defer c.shellFuncsMu.Unlock()
+
+	// The failure isn't cached, as it may be due to the context of the call, like a timeout
+	if c.shellFuncs == nil {
+		funcs, err := c.listShellFuncs(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		c.shellFuncs = funcs
+	}
+
+	_, ok := c.shellFuncs[name]
+
+	return ok, nil
+}
+
+func (c *App) listShellFuncs(ctx context.Context) (map[string]struct{}, error) {
+	funcs := map[string]struct{}{}
+
+	list := c.dialect().ListFunctions()
+	if len(c.Sources) == 0 || list == "" {
+		return funcs, nil
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, c.shellPath(), "-c", c.sourceScript()+list)
+	cmd.Dir = c.Dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed listing shell functions in %s: %w: %s", strings.Join(c.Sources, ", "), err, stderr.String())
+	}
+
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := fields[len(fields)-1]
+
+		// Exported Go functions are defined as shell functions, too
+		if _, ok := c.funcs[name]; ok {
+			continue
+		}
+
+		funcs[name] = struct{}{}
+	}
+
+	return funcs, nil
+}
@@ -0,0 +1,85 @@
+package gosh_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/context"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSource(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("hello", func(ctx context.Context, target string) {
+		fmt.Fprintf(context.Stdout(ctx), "hello %s\n", target)
+	})
+
+	sh.Source("testdata/lib/*.sh")
+
+	goshtest.Run(t, sh, func() {
+		t.Run("shell func", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			err := sh.Run(t, "greet", "world", gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "greetings, world\n", stdout.String())
+		})
+
+		t.Run("shell func calling go func", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			err := sh.Run(t, "greet_in_go", "world", gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "hello world\n", stdout.String())
+		})
+
+		t.Run("nested shell", func(t *testing.T) {
+			var stdout bytes.Buffer
+
+			err := sh.Run(t, "bash", "-c", "greet world", gosh.WriteStdout(&stdout))
+
+			assert.NoError(t, err)
+			assert.Equal(t, "greetings, world\n", stdout.String())
+		})
+	})
+}
+
+func TestSourceMissing(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Source("testdata/missing/*.sh")
+
+	goshtest.Run(t, sh, func() {
+		err := sh.Run(t, "true")
+
+		assert.Error(t, err)
+	})
+}
+
+func TestSourceRetry(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Source("testdata/lib/*.sh")
+
+	goshtest.Run(t, sh, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := sh.Run(t, ctx, "greet", "world")
+
+		assert.Error(t, err)
+
+		var stdout bytes.Buffer
+
+		err = sh.Run(t, "greet", "world", gosh.WriteStdout(&stdout))
+
+		assert.NoError(t, err, "must not fail forever after the listing of the shell funcs failed")
+		assert.Equal(t, "greetings, world\n", stdout.String())
+	})
+}
@@ -0,0 +1,110 @@
+package gosh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mumoshu/gosh/context"
+)
+
+// Map returns the pipeline stage that writes f(line) for each line read from the stdin, like `sed`.
+//
+// The stages returned by Map, Filter and Each run as goroutines in the current process, without spawning a process,
+// so that you can write a pipeline stage in Go without exporting a function:
+//
+//	sh.Run(gosh.Cmd("kubectl", "get", "po"), gosh.Filter(func(l string) bool {
+//		return strings.Contains(l, "Running")
+//	}), gosh.Map(strings.ToUpper))
+//
+// The lines are passed without the trailing newline.
+func Map(f func(line string) string) Command {
+	return lineStage(func(w io.Writer, line string) error {
+		_, err := io.WriteString(w, f(line)+"\n")
+		return err
+	})
+}
+
+// Filter returns the pipeline stage that writes the lines read from the stdin for which f returns true, like `grep`.
+func Filter(f func(line string) bool) Command {
+	return lineStage(func(w io.Writer, line string) error {
+		if !f(line) {
+			return nil
+		}
+
+		_, err := io.WriteString(w, line+"\n")
+		return err
+	})
+}
+
+// Each returns the pipeline stage that calls f for each line read from the stdin, writing nothing.
+// It stops at the first error returned by f, which fails the pipeline.
+func Each(f func(line string) error) Command {
+	return lineStage(func(_ io.Writer, line string) error {
+		return f(line)
+	})
+}
+
+// lineStage returns the stage that calls f for each line read from the stdin.
+// As the stdin and stdout are pipes in a pipeline, it reads the next line only after the previous one is read by the next stage.
+func lineStage(f func(w io.Writer, line string) error) Command {
+	return Command{
+		stage: func(ctx context.Context) error {
+			r := bufio.NewReader(context.Stdin(ctx))
+			w := context.Stdout(ctx)
+
+			for {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				line, err := r.ReadString('\n')
+				if line != "" {
+					if err := f(w, strings.TrimSuffix(line, "\n")); err != nil {
+						return err
+					}
+				}
+
+				if err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		},
+	}
+}
+
+// runStage runs the in-process stage with the options in the vars of the command, like the ones added by Stderr2Stdout.
+func (t *Shell) runStage(ctx context.Context, c Command) error {
+	var rc RunConfig
+
+	for _, v := range c.Vars {
+		o, ok := v.(RunOption)
+		if !ok {
+			return fmt.Errorf("unexpected arg to an in-process stage: %v(%T)", v, v)
+		}
+
+		o(&rc)
+	}
+
+	ctx = t.app.withRunConfig(ctx, rc)
+
+	ctx, closeStdin, err := withStdin(ctx, rc.Stdin)
+	if err != nil {
+		return err
+	}
+	defer closeStdin()
+
+	rc, closeStdout, err := openStdoutFile(rc, context.Dir(ctx))
+	if err != nil {
+		return err
+	}
+	defer closeStdout()
+
+	ctx, _, flushOutputs := withOutputs(ctx, rc)
+	defer flushOutputs()
+
+	return runWithTimeout(ctx, rc.Timeout, c.stage)
+}
@@ -0,0 +1,62 @@
+package gosh_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStdin(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("upper", func(ctx gosh.Context) error {
+		in, err := ioutil.ReadAll(ctx.Stdin())
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprint(ctx.Stdout(), strings.ToUpper(string(in)))
+
+		return nil
+	})
+
+	goshtest.Run(t, sh, func() {
+		var stdout bytes.Buffer
+
+		err := sh.Run(t, gosh.Script(`read name; read color; echo "$name likes $color"`), gosh.StdinString("alice\nblue\n"), gosh.WriteStdout(&stdout))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "alice likes blue\n", stdout.String())
+
+		stdout.Reset()
+
+		err = sh.Run(t, "upper", gosh.StdinString("hello\n"), gosh.WriteStdout(&stdout))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "HELLO\n", stdout.String())
+
+		stdout.Reset()
+
+		err = sh.Run(t, "cat", gosh.ReadStdin(strings.NewReader("from reader\n")), gosh.WriteStdout(&stdout))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "from reader\n", stdout.String())
+
+		stdout.Reset()
+
+		err = sh.Run(t, "bash", "-c", "upper", gosh.StdinFile("testdata/answers.txt"), gosh.WriteStdout(&stdout))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "YES\nNO\n", stdout.String())
+
+		err = sh.Run(t, "cat", gosh.StdinFile("testdata/missing.txt"))
+
+		assert.Error(t, err)
+	})
+}
@@ -32,7 +32,8 @@ import (
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 // SOFTWARE.
 
-type Filter func(name string) string
+// NameFilter maps the name of a struct field or tag to the name of a flag, envvar or usage.
+type NameFilter func(name string) string
 
 var defaultFilter = func(s string) string {
 	return s
@@ -40,9 +41,9 @@ var defaultFilter = func(s string) string {
 
 // structFieldsReflector is used to map the fields of a struct into flags of a flag.FlagSet
 type structFieldsReflector struct {
-	TagToEnvName    Filter
-	TagToUsage      Filter
-	FieldToFlagName Filter
+	TagToEnvName    NameFilter
+	TagToUsage      NameFilter
+	FieldToFlagName NameFilter
 }
 
 func (f *structFieldsReflector) SetStruct(cmd string, v reflect.Value, args []interface{}) error {
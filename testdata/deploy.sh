@@ -0,0 +1,8 @@
+set -e
+
+setup_cluster() {
+  echo "setting up $1"
+  ls /nonexistent
+}
+
+setup_cluster foo
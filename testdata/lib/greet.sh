@@ -0,0 +1,7 @@
+greet() {
+  echo "greetings, $1"
+}
+
+greet_in_go() {
+  hello "$1"
+}
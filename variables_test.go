@@ -0,0 +1,78 @@
+package gosh_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/mumoshu/gosh"
+	"github.com/mumoshu/gosh/context"
+	"github.com/mumoshu/gosh/goshtest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVariables(t *testing.T) {
+	user := context.NewSessionKey[string]("user")
+	token := context.NewKey[string]("token")
+
+	sh := &gosh.Shell{}
+
+	sh.Export("login", func(ctx gosh.Context, name string) error {
+		if err := user.Set(ctx, name); err != nil {
+			return err
+		}
+
+		return token.Set(ctx, "secret")
+	})
+
+	sh.Export("whoami", func(ctx gosh.Context) {
+		t, ok := token.Lookup(ctx)
+
+		fmt.Fprintf(ctx.Stdout(), "user=%s token=%s,%v\n", user.Get(ctx), t, ok)
+	})
+
+	sh.Export("sudo", func(ctx gosh.Context, cmd string) error {
+		// The session variable is global to the session, so it's restored after the command
+		prev := user.Get(ctx)
+		defer user.Set(ctx, prev)
+
+		if err := user.Set(ctx, "root"); err != nil {
+			return err
+		}
+
+		// The nested shell is in the same session
+		return ctx.Run("bash", "-c", cmd)
+	})
+
+	goshtest.Run(t, sh, func() {
+		var stdout bytes.Buffer
+
+		err := sh.Run(t, "bash", "-c", "login alice; whoami; sudo whoami; whoami", gosh.WriteStdout(&stdout))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "user=alice token=,false\nuser=root token=,false\nuser=alice token=,false\n", stdout.String())
+	})
+}
+
+func TestDepVariables(t *testing.T) {
+	sh := &gosh.Shell{}
+
+	sh.Export("setup", func(ctx gosh.Context, name string) error {
+		context.Set(ctx, "cluster-name", name)
+
+		return context.Export(ctx, "cluster-name")
+	})
+
+	sh.Export("deploy", func(ctx gosh.Context) {
+		fmt.Fprintf(ctx.Stdout(), "deploying to %v\n", context.Get(ctx, "cluster-name"))
+	}, gosh.Dep("setup", "dev"))
+
+	goshtest.Run(t, sh, func() {
+		var stdout bytes.Buffer
+
+		err := sh.Run(t, "deploy", gosh.WriteStdout(&stdout))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "deploying to dev\n", stdout.String())
+	})
+}